@@ -3,6 +3,7 @@ module DataSoup
 go 1.23.1
 
 require (
-	github.com/saintfish/chardet v0.0.0-20230101081208-5e3ef4b5456d // indirect
-	golang.org/x/text v0.20.0 // indirect
+	github.com/saintfish/chardet v0.0.0-20230101081208-5e3ef4b5456d
+	golang.org/x/text v0.20.0
+	gopkg.in/yaml.v3 v3.0.1
 )
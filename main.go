@@ -1,22 +1,43 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
+	"math"
 	"math/rand/v2"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"unicode/utf16"
 
 	"golang.org/x/text/encoding/charmap"
+	"gopkg.in/yaml.v3"
 
 	"github.com/saintfish/chardet"
 )
@@ -128,495 +149,5398 @@ type SendMessagePayload struct {
 	Entities []MessageEntity `json:"entities"`
 }
 
-func fetchResource(resource Resource, datapackage FileResultItem, waitGroup *sync.WaitGroup, client *http.Client, backoff int) {
-	defer waitGroup.Done()
-	dirpath := filepath.Join("data", datapackage.Organization.Name, datapackage.Id)
-	// create all directories
-	err := os.MkdirAll(dirpath, 0666)
+// a resource that failed on a previous run and must be fetched again on the next one
+type RetryEntry struct {
+	Category string    `json:"category"`
+	Reason   string    `json:"reason"`
+	Since    time.Time `json:"since"`
+	Attempts int       `json:"attempts"`
+	// the version we failed on, a newer one starts with a fresh budget
+	MetadataModified string `json:"metadata_modified"`
+}
+
+type InvalidDownloadError struct {
+	Reason string
+	// zero unless the status code was the problem
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *InvalidDownloadError) Error() string {
+	return "invalid download: " + e.Reason
+}
+
+// the server sometimes answers with an html page saying 'Internal Server Error' or a json error instead of the csv
+// sniff is the start of the body, it should be at least 512 bytes when the body is that long
+func validateDownload(resp *http.Response, sniff []byte) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &InvalidDownloadError{
+			Reason:     fmt.Sprintf("unexpected status %s", resp.Status),
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "application/json", "application/problem+json":
+		return &InvalidDownloadError{Reason: fmt.Sprintf("unexpected content type %s", mediaType)}
+	}
+	if len(sniff) == 0 {
+		return &InvalidDownloadError{Reason: "empty body"}
+	}
+	// skip the byte order mark and leading whitespace before looking at the body
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(sniff, []byte("\xEF\xBB\xBF")))
+	if len(trimmed) == 0 {
+		return &InvalidDownloadError{Reason: "blank body"}
+	}
+	sniffedType := http.DetectContentType(trimmed)
+	if strings.HasPrefix(sniffedType, "text/html") || strings.HasPrefix(sniffedType, "text/xml") {
+		return &InvalidDownloadError{Reason: "body looks like html"}
+	}
+	// a csv never starts with a brace, an api error does
+	if trimmed[0] == '{' {
+		return &InvalidDownloadError{Reason: "body looks like json"}
+	}
+	return nil
+}
+
+// keep the rejected response around so we can figure out what the server was thinking
+func quarantineDownload(logger *slog.Logger, resource Resource, datapackage FileResultItem, resp *http.Response, body []byte, reason error) {
+	dirpath := filepath.Join("data", "quarantine")
+	err := os.MkdirAll(dirpath, 0755)
 	if err != nil {
-		log.Fatalln(err)
+		logger.Warn("Failed to create quarantine directory", "err", err)
+		return
 	}
-	// create request with custom UA datagov-external-client
-	req, err := http.NewRequest("GET", resource.Url, nil)
+	resourceId := resource.Id
+	if !safePathComponent.MatchString(resourceId) {
+		resourceId = "invalid-id"
+	}
+	name := fmt.Sprintf("%s-%s", resourceId, time.Now().UTC().Format("20060102T150405Z"))
+	diagnostics := map[string]any{
+		"time":         time.Now().UTC(),
+		"reason":       reason.Error(),
+		"resource_id":  resource.Id,
+		"package_id":   datapackage.Id,
+		"organization": datapackage.Organization.Name,
+		"url":          resource.Url,
+		"status":       resp.Status,
+		"headers":      resp.Header,
+		"body_length":  len(body),
+	}
+	diagnosticsJson, err := json.MarshalIndent(diagnostics, "", "  ")
 	if err != nil {
-		log.Fatalln(err)
+		logger.Warn("Failed to encode quarantine diagnostics", "err", err)
+		return
 	}
-	req.Header.Set("User-Agent", "github.com/wissotsky#datagov-external-client")
-	// send request
-	resp, err := client.Do(req)
+	err = os.WriteFile(filepath.Join(dirpath, name+".json"), diagnosticsJson, 0644)
+	if err != nil {
+		logger.Warn("Failed to write quarantine diagnostics", "err", err)
+		return
+	}
+	err = os.WriteFile(filepath.Join(dirpath, name+".body"), body, 0644)
 	if err != nil {
-		log.Println(err)
+		logger.Warn("Failed to write quarantined body", "err", err)
 		return
 	}
-	// create file
-	file, err := os.Create(filepath.Join(dirpath, resource.Id+".csv"))
+	logger.Info("Quarantined the rejected download", "path", filepath.Join(dirpath, name+".body"))
+}
+
+// what we know about a stored resource, committed to the state journal one resource at a time
+type ResourceState struct {
+	PackageId string `json:"package_id"`
+	// the directory the dataset is stored under, the organization name unless that is not usable as a path
+	Organization string `json:"organization"`
+	// the organization name as the catalogue has it, for the logs
+	OrganizationName string    `json:"organization_name,omitempty"`
+	MetadataModified string    `json:"metadata_modified"`
+	UpdatedAt        time.Time `json:"updated_at"`
+	// hash of the stored version in the snapshot store
+	SHA256 string `json:"sha256,omitempty"`
+	// set when the last download was rejected
+	Retry *RetryEntry `json:"retry,omitempty"`
+	// notification that was committed together with the file but not sent yet
+	Outbox *SendMessagePayload `json:"outbox,omitempty"`
+	// gc evicted what we had stored, the next update stores the resource again without announcing all of it as new
+	Evicted bool `json:"evicted,omitempty"`
+}
+
+type State struct {
+	Resources map[string]ResourceState `json:"resources"`
+}
+
+type StateJournalEntry struct {
+	Id    string        `json:"id"`
+	State ResourceState `json:"state"`
+}
+
+// state.json is the compacted snapshot, every change in between is appended to state.journal and fsynced
+// so a crash never loses a resource that was already written to disk
+type StateStore struct {
+	mu          sync.Mutex
+	path        string
+	journalPath string
+	journal     *os.File
+	state       State
+}
+
+func loadState(path string) (*StateStore, error) {
+	store, journalData, err := readState(path)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
-	// copy from request and close
-	_, err = io.Copy(file, resp.Body)
+	store.journal, err = os.OpenFile(store.journalPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		// Panics here if the server closes the socket before we finish reading
-		log.Println(resource.Url, resource.Name, err)
-		// Backoff and retry
-		file.Close()
-		resp.Body.Close()
+		return nil, err
+	}
+	// cut off a half written last line so new entries start on a line of their own
+	if len(journalData) > 0 && journalData[len(journalData)-1] != '\n' {
+		err = store.journal.Truncate(int64(bytes.LastIndexByte(journalData, '\n') + 1))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
 
-		// sleep for backoff time + random jitter of half backoff time to prevent crowding
-		chosenBackoff := backoff + rand.IntN(backoff/2)
-		time.Sleep(time.Duration(chosenBackoff) * time.Second)
-		log.Println("Retrying", resource.Name, "after backoff", chosenBackoff)
-		waitGroup.Add(1)
-		go fetchResource(resource, datapackage, waitGroup, client, (backoff * 2))
+// the state as it is on disk without touching the journal, for looking at it while a run may be writing
+// the store can not be written to
+func peekState(path string) (*StateStore, error) {
+	store, _, err := readState(path)
+	return store, err
+}
+
+func readState(path string) (*StateStore, []byte, error) {
+	store := &StateStore{
+		path:        path,
+		journalPath: strings.TrimSuffix(path, ".json") + ".journal",
+		state:       State{Resources: make(map[string]ResourceState)},
+	}
+	data, err := os.ReadFile(store.path)
+	if err == nil {
+		err = json.Unmarshal(data, &store.state)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse %s: %v", store.path, err)
+		}
+		if store.state.Resources == nil {
+			store.state.Resources = make(map[string]ResourceState)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	// replay whatever was committed after the last snapshot
+	journalData, err := os.ReadFile(store.journalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, line := range bytes.Split(journalData, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry StateJournalEntry
+		err := json.Unmarshal(line, &entry)
+		if err != nil {
+			// the last line is cut short if we died while appending it
+			slog.Warn("Ignoring damaged state journal entry", "path", store.journalPath, "err", err)
+			continue
+		}
+		store.state.Resources[entry.Id] = entry.State
+	}
+	return store, journalData, nil
+}
+
+func (s *StateStore) Get(resourceId string) (ResourceState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resourceState, ok := s.state.Resources[resourceId]
+	return resourceState, ok
+}
+
+// resources that have a notification waiting to be sent
+func (s *StateStore) Pending() map[string]ResourceState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := make(map[string]ResourceState)
+	for resourceId, resourceState := range s.state.Resources {
+		if resourceState.Outbox != nil {
+			pending[resourceId] = resourceState
+		}
+	}
+	return pending
+}
+
+// a copy of every entry
+func (s *StateStore) All() map[string]ResourceState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make(map[string]ResourceState, len(s.state.Resources))
+	for resourceId, resourceState := range s.state.Resources {
+		all[resourceId] = resourceState
+	}
+	return all
+}
+
+func (s *StateStore) Put(resourceId string, resourceState ResourceState) error {
+	line, err := json.Marshal(StateJournalEntry{Id: resourceId, State: resourceState})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.journal.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	err = s.journal.Sync()
+	if err != nil {
+		return err
+	}
+	s.state.Resources[resourceId] = resourceState
+	return nil
+}
+
+// fold the journal into state.json
+func (s *StateStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(s.path, data, 0644)
+	if err != nil {
+		return err
+	}
+	// everything in the journal is in the snapshot now
+	return s.journal.Truncate(0)
+}
+
+func (s *StateStore) Close() error {
+	if s.journal == nil {
+		return nil
+	}
+	return s.journal.Close()
+}
+
+// write into a temporary file next to the target, fsync it and rename it over the target
+// so a crash leaves either the old or the new file but never a truncated one
+func writeReaderAtomic(path string, r io.Reader, perm os.FileMode) (int64, error) {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	// no-op once the rename went through
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return written, err
+	}
+	err = tmp.Chmod(perm)
+	if err != nil {
+		tmp.Close()
+		return written, err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return written, err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return written, err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return written, err
+	}
+	return written, syncDir(dir)
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	_, err := writeReaderAtomic(path, bytes.NewReader(data), perm)
+	return err
+}
+
+// make the rename itself durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %s: %s", e.Status, e.Body)
+}
+
+// the part of a telegram error we care about
+type TelegramError struct {
+	Parameters struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// secrets that must never end up in the output, every log line is scrubbed of them
+type Redactor struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+var redactor = &Redactor{}
+
+func (r *Redactor) Add(secret string) {
+	// short strings would scrub half the output and are no secret anyway
+	if len(secret) < 8 {
 		return
 	}
-	file.Close()
-	resp.Body.Close()
-	// print success
-	fmt.Println("Downloaded", resource.Name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secrets = append(r.secrets, secret)
+	if escaped := url.PathEscape(secret); escaped != secret {
+		r.secrets = append(r.secrets, escaped)
+	}
 }
 
-// find the maximum amount of rows we can fit in from the diff to be under telegram's character limits
-func findSubSliceOfMaxLen(slice []string, maxlen int, prefixLen int) ([]string, int) {
-	var subSlice []string
-	curLen := prefixLen
-	for _, s := range slice {
-		if curLen+len(s) < maxlen {
-			subSlice = append(subSlice, s)
-			curLen += len(s)
-		} else {
-			break
+func (r *Redactor) Redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, "<redacted>")
+	}
+	return s
+}
+
+// a log output that scrubs the secrets from every line
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	_, err := w.w.Write([]byte(redactor.Redact(string(p))))
+	return len(p), err
+}
+
+// the bot api, the token is part of every url so it is kept out of every error that carries one
+type TelegramClient struct {
+	client *http.Client
+	token  string
+	// counts the 429s, nil when nobody is counting
+	metrics *Metrics
+}
+
+// with the token from the environment, the config or the token file
+func NewTelegramClient(config *Config) (*TelegramClient, error) {
+	if config.Telegram.Token == "" {
+		return nil, errors.New("no telegram token, set TELEGRAM_TOKEN, telegram.token in the config or put it in " + config.Telegram.TokenFile)
+	}
+	redactor.Add(config.Telegram.Token)
+	return &TelegramClient{
+		client: &http.Client{Timeout: time.Minute},
+		token:  config.Telegram.Token,
+	}, nil
+}
+
+// post a bot api method and return the body of a successful answer
+func (t *TelegramClient) call(method string, payload any) ([]byte, error) {
+	payloadJson, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.client.Post(fmt.Sprint("https://api.telegram.org/bot", t.token, "/", method), "application/json", bytes.NewReader(payloadJson))
+	if err != nil {
+		return nil, t.scrub(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, t.scrub(err)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		t.metrics.addRateLimited()
+	}
+	if resp.StatusCode != http.StatusOK {
+		statusErr := &HTTPStatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       string(body),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
 		}
+		// telegram says how long to back off in the body
+		var telegramErr TelegramError
+		if json.Unmarshal(body, &telegramErr) == nil && telegramErr.Parameters.RetryAfter > 0 {
+			statusErr.RetryAfter = time.Duration(telegramErr.Parameters.RetryAfter) * time.Second
+		}
+		return nil, statusErr
 	}
-	remainingCount := len(slice) - len(subSlice)
-	return subSlice, remainingCount
+	return body, nil
 }
 
-func isResourceExempt(resourceId string) bool {
-	switch resourceId {
-	case
-		"053cea08-09bc-40ec-8f7a-156f0677aff3",
-		"aba233c2-6a5a-487d-b0a8-9413ef849f15":
-		return true
+// the url in a transport error has the token in it, the error stays what it was otherwise so retries still see through it
+func (t *TelegramClient) scrub(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = strings.ReplaceAll(urlErr.URL, t.token, "<redacted>")
 	}
-	return false
+	return err
 }
 
-func processDiffToPayload(isNewResource bool, diff []string, datapackage FileResultItem, resource Resource) SendMessagePayload {
-	// TODO: if diff length is equal to zero it means there is no difference between the files, therefore dont send a message
-	var prefix string
-	if isNewResource {
-		fmt.Println("TODO Notification: Added New Resource ", resource.Name)
-		prefix = "📗 New Resource: "
-	} else {
-		fmt.Println("TODO Notification: Updated Resource ", resource.Name)
-		prefix = "📘 Update: "
+// check that the token works
+func (t *TelegramClient) GetMe() error {
+	body, err := t.call("getMe", struct{}{})
+	if err != nil {
+		return err
 	}
+	slog.Debug("Telegram getMe", "response", string(body))
+	return nil
+}
 
-	// if its the flight data we will process it differently //TODO: make a more robust system for processing exceptional data
-	isFlightData := false
-	isRegularDiff := true
-	if resource.Id == "e83f763b-b7d7-479e-b172-ae981ddc6de5" {
-		isRegularDiff = false
-		isFlightData = true
-		prefix = "✈ Flights Update: "
+func (t *TelegramClient) SendMessage(payload SendMessagePayload) error {
+	body, err := t.call("sendMessage", payload)
+	if err != nil {
+		return err
+	}
+	slog.Debug("Telegram sendMessage", "chat_id", payload.ChatId, "response", string(body))
+	return nil
+}
+
+// a single resource handed to the download pipeline
+type DownloadJob struct {
+	Package  FileResultItem
+	Resource Resource
+}
+
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// rate is in tokens per second, the bucket starts full
+func NewTokenBucket(rate float64, burst float64) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take n tokens, going into debt and sleeping it off if there are not enough
+func (b *TokenBucket) WaitN(ctx context.Context, n float64) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shared by bootstrap and normal runs so both are equally polite to data.gov.il
+type Downloader struct {
+	client    *http.Client
+	userAgent string
+	// a server that sends nothing for this long, before the headers or within a body, fails with a timeout
+	headerTimeout time.Duration
+	idleTimeout   time.Duration
+	workers       int
+	hostRate      float64
+	// nil when bandwidth is not capped
+	bandwidth *TokenBucket
+	// one slot per request in flight
+	slots chan struct{}
+	mu    sync.Mutex
+	hosts map[string]*TokenBucket
+	// bytes read from response bodies so far, for progress reporting
+	downloaded atomic.Int64
+}
+
+// hostRate is in requests per second per host and maxBandwidth in bytes per second over all downloads, zero means unlimited
+func NewDownloader(config DownloadConfig, workers int, maxConnections int, hostRate float64, maxBandwidth int64) *Downloader {
+	downloader := &Downloader{
+		// no overall timeout, a big resource may take long as long as it keeps coming
+		client: &http.Client{Transport: &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+			MaxConnsPerHost:       config.MaxConnsPerHost,
+		}},
+		userAgent:     config.UserAgent,
+		headerTimeout: config.ResponseHeaderTimeout,
+		idleTimeout:   config.IdleTimeout,
+		workers:       max(workers, 1),
+		hostRate:      hostRate,
+		slots:         make(chan struct{}, max(maxConnections, 1)),
+		hosts:         make(map[string]*TokenBucket),
+	}
+	if maxBandwidth > 0 {
+		// allow a second worth of bytes in a burst
+		downloader.bandwidth = NewTokenBucket(float64(maxBandwidth), float64(maxBandwidth))
+	}
+	return downloader
+}
+
+func (d *Downloader) hostBucket(host string) *TokenBucket {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	bucket, ok := d.hosts[host]
+	if !ok {
+		bucket = NewTokenBucket(d.hostRate, math.Max(d.hostRate, 1))
+		d.hosts[host] = bucket
+	}
+	return bucket
+}
+
+// send a GET once the host allows it and a connection slot is free
+// the slot is held until the body is closed and reading the body counts against the bandwidth cap
+func (d *Downloader) Get(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	// the request is cancelled when the body stalls
+	requestCtx, cancel := context.WithCancel(ctx)
+	// create request with custom UA datagov-external-client
+	req, err := http.NewRequestWithContext(requestCtx, "GET", url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("User-Agent", d.userAgent)
+	if d.hostRate > 0 {
+		err = d.hostBucket(req.URL.Host).WaitN(ctx, 1)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	select {
+	case d.slots <- struct{}{}:
+	case <-ctx.Done():
+		cancel()
+		return nil, ctx.Err()
+	}
+	// send request
+	resp, err := d.client.Do(req)
+	if err != nil {
+		cancel()
+		<-d.slots
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			// the transport gave up waiting for the headers, unlike a deadline of ours that is worth another try
+			return nil, &StalledError{After: d.headerTimeout}
+		}
+		return nil, err
+	}
+	body := &downloadBody{
+		body:        resp.Body,
+		ctx:         ctx,
+		bandwidth:   d.bandwidth,
+		counter:     &d.downloaded,
+		idleTimeout: d.idleTimeout,
+		release: func() {
+			cancel()
+			<-d.slots
+		},
+	}
+	body.idle = time.AfterFunc(d.idleTimeout, func() {
+		body.stalled.Store(true)
+		cancel()
+	})
+	body.idle.Stop()
+	resp.Body = body
+	return resp, nil
+}
+
+// hand the jobs to a fixed number of workers, no new jobs are started once stop is closed or ctx is cancelled
+// returns whether every job was handed out
+func (d *Downloader) Run(ctx context.Context, stop <-chan struct{}, jobs []DownloadJob, handle func(ctx context.Context, job DownloadJob)) bool {
+	queue := make(chan DownloadJob)
+	var waitGroup sync.WaitGroup
+	for range d.workers {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for job := range queue {
+				handle(ctx, job)
+			}
+		}()
+	}
+	complete := true
+feed:
+	for _, job := range jobs {
+		select {
+		case queue <- job:
+		case <-stop:
+			complete = false
+			break feed
+		case <-ctx.Done():
+			complete = false
+			break feed
+		}
+	}
+	close(queue)
+	waitGroup.Wait()
+	return complete
+}
+
+type downloadBody struct {
+	body      io.ReadCloser
+	ctx       context.Context
+	bandwidth *TokenBucket
+	counter   *atomic.Int64
+	release   func()
+	once      sync.Once
+	// armed while a read waits for the server, waiting on the bandwidth cap does not count
+	idle        *time.Timer
+	idleTimeout time.Duration
+	stalled     atomic.Bool
+}
+
+// the server stopped sending in the middle of a body, retried like any other timeout
+type StalledError struct {
+	After time.Duration
+}
+
+func (e *StalledError) Error() string {
+	return fmt.Sprintf("no data received for %s", e.After)
+}
+
+func (e *StalledError) Timeout() bool   { return true }
+func (e *StalledError) Temporary() bool { return true }
+
+func (b *downloadBody) read(p []byte) (int, error) {
+	b.idle.Reset(b.idleTimeout)
+	n, err := b.body.Read(p)
+	b.idle.Stop()
+	b.counter.Add(int64(n))
+	if err != nil && b.stalled.Load() {
+		// the cancelled request would otherwise look like we gave up ourselves
+		err = &StalledError{After: b.idleTimeout}
+	}
+	return n, err
+}
+
+func (b *downloadBody) Read(p []byte) (int, error) {
+	if b.bandwidth == nil {
+		return b.read(p)
+	}
+	// small reads keep the throttling smooth
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := b.read(p)
+	if n > 0 {
+		waitErr := b.bandwidth.WaitN(b.ctx, float64(n))
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (b *downloadBody) Close() error {
+	b.idle.Stop()
+	err := b.body.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// one stored version of a resource
+type SnapshotVersion struct {
+	FetchedAt        time.Time `json:"fetched_at"`
+	MetadataModified string    `json:"metadata_modified"`
+	SHA256           string    `json:"sha256"`
+	Size             int64     `json:"size"`
+	Rows             int       `json:"rows"`
+	// what it took on disk when it was recorded, zero if the content was already stored
+	StoredSize int64 `json:"stored_size"`
+}
+
+// content addressed store for every version we ever fetched, a version that shows up in several places is stored once
+// objects are gzipped, with deltas on a new version is stored as the bytes that changed since the previous one
+// the version history of a resource lives next to its csv in <resource>.versions.json
+type SnapshotStore struct {
+	dir    string
+	deltas bool
+}
+
+const (
+	objectFull  = 'F'
+	objectDelta = 'D'
+	// longest chain of deltas before a version is stored in full again, keeps reads cheap
+	maxDeltaChain = 8
+)
+
+func NewSnapshotStore(dir string, deltas bool) *SnapshotStore {
+	return &SnapshotStore{dir: dir, deltas: deltas}
+}
+
+func (s *SnapshotStore) objectPath(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+func (s *SnapshotStore) createObject() (*os.File, *gzip.Writer, error) {
+	err := os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".object.*.tmp")
+	if err != nil {
+		return nil, nil, err
+	}
+	return tmp, gzip.NewWriter(tmp), nil
+}
+
+// move a finished object into place, returns the bytes it takes on disk or zero if we already had it
+func (s *SnapshotStore) commitObject(tmp *os.File, hash string) (int64, error) {
+	defer os.Remove(tmp.Name())
+	err := tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	fileInfo, err := tmp.Stat()
+	closeErr := tmp.Close()
+	if err != nil {
+		return 0, err
+	}
+	if closeErr != nil {
+		return 0, closeErr
+	}
+	objectPath := s.objectPath(hash)
+	if _, err := os.Stat(objectPath); err == nil {
+		// already have it
+		return 0, nil
+	}
+	err = os.MkdirAll(filepath.Dir(objectPath), 0755)
+	if err != nil {
+		return 0, err
+	}
+	err = os.Rename(tmp.Name(), objectPath)
+	if err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), syncDir(filepath.Dir(objectPath))
+}
+
+// stream the content into the store, hashing and counting rows on the way
+func (s *SnapshotStore) Put(r io.Reader) (SnapshotVersion, error) {
+	var version SnapshotVersion
+	tmp, zw, err := s.createObject()
+	if err != nil {
+		return version, err
+	}
+	hasher := sha256.New()
+	counter := &lineCounter{}
+	_, err = zw.Write([]byte{objectFull})
+	if err == nil {
+		version.Size, err = io.Copy(io.MultiWriter(zw, hasher, counter), r)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return version, err
+	}
+	version.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	version.Rows = counter.rows()
+	version.StoredSize, err = s.commitObject(tmp, version.SHA256)
+	return version, err
+}
+
+// store the content as the difference to the base version, falls back to a full copy when that does not pay off
+func (s *SnapshotStore) putDelta(content []byte, baseHash string) (SnapshotVersion, error) {
+	base, depth, err := s.load(baseHash)
+	if err != nil || depth >= maxDeltaChain {
+		return s.Put(bytes.NewReader(content))
+	}
+	// most updates append or change a few rows, so what is left between the common prefix and suffix is small
+	prefix := 0
+	for prefix < len(base) && prefix < len(content) && base[prefix] == content[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(base)-prefix && suffix < len(content)-prefix && base[len(base)-1-suffix] == content[len(content)-1-suffix] {
+		suffix++
+	}
+	middle := content[prefix : len(content)-suffix]
+	if len(middle) > len(content)/2 {
+		return s.Put(bytes.NewReader(content))
+	}
+
+	sum := sha256.Sum256(content)
+	counter := &lineCounter{}
+	counter.Write(content)
+	version := SnapshotVersion{
+		SHA256: hex.EncodeToString(sum[:]),
+		Size:   int64(len(content)),
+		Rows:   counter.rows(),
+	}
+	if _, err := os.Stat(s.objectPath(version.SHA256)); err == nil {
+		return version, nil
+	}
+	tmp, zw, err := s.createObject()
+	if err != nil {
+		return version, err
+	}
+	header := []byte{objectDelta}
+	header = append(header, baseHash...)
+	header = binary.AppendUvarint(header, uint64(prefix))
+	header = binary.AppendUvarint(header, uint64(suffix))
+	_, err = zw.Write(header)
+	if err == nil {
+		_, err = zw.Write(middle)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return version, err
+	}
+	version.StoredSize, err = s.commitObject(tmp, version.SHA256)
+	return version, err
+}
+
+// read an object back, following the delta chain, along with how long that chain was
+func (s *SnapshotStore) load(hash string) ([]byte, int, error) {
+	data, err := os.ReadFile(s.objectPath(hash))
+	if err != nil {
+		return nil, 0, err
+	}
+	// objects from before compression are stored as is
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, 0, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(raw) == 0 {
+		return nil, 0, fmt.Errorf("object %s is empty", hash)
+	}
+	switch raw[0] {
+	case objectFull:
+		return raw[1:], 0, nil
+	case objectDelta:
+		if len(raw) < 1+sha256.Size*2 {
+			return nil, 0, fmt.Errorf("object %s is cut short", hash)
+		}
+		baseHash := string(raw[1 : 1+sha256.Size*2])
+		rest := raw[1+sha256.Size*2:]
+		prefix, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, 0, fmt.Errorf("object %s has a bad delta header", hash)
+		}
+		rest = rest[n:]
+		suffix, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, 0, fmt.Errorf("object %s has a bad delta header", hash)
+		}
+		middle := rest[n:]
+		base, depth, err := s.load(baseHash)
+		if err != nil {
+			return nil, 0, fmt.Errorf("base %s of object %s: %v", baseHash, hash, err)
+		}
+		if prefix+suffix > uint64(len(base)) {
+			return nil, 0, fmt.Errorf("object %s does not fit its base", hash)
+		}
+		content := make([]byte, 0, int(prefix)+len(middle)+int(suffix))
+		content = append(content, base[:prefix]...)
+		content = append(content, middle...)
+		content = append(content, base[uint64(len(base))-suffix:]...)
+		return content, depth + 1, nil
+	}
+	return nil, 0, fmt.Errorf("object %s is of unknown kind %q", hash, raw[0])
+}
+
+// the content of a version, checked against its hash
+func (s *SnapshotStore) Read(hash string) ([]byte, error) {
+	content, _, err := s.load(hash)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(content)
+	if hex.EncodeToString(sum[:]) != hash {
+		return nil, fmt.Errorf("object %s is corrupted", hash)
+	}
+	return content, nil
+}
+
+// store the content and append it to the version history of the csv
+func (s *SnapshotStore) Record(csvPath string, r io.Reader, fetchedAt time.Time, metadataModified string) (SnapshotVersion, error) {
+	versions, err := loadVersions(csvPath)
+	if err != nil {
+		return SnapshotVersion{}, err
+	}
+	var version SnapshotVersion
+	if s.deltas && len(versions) > 0 {
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return version, err
+		}
+		version, err = s.putDelta(content, versions[len(versions)-1].SHA256)
+		if err != nil {
+			return version, err
+		}
+	} else {
+		version, err = s.Put(r)
+		if err != nil {
+			return version, err
+		}
+	}
+	version.FetchedAt = fetchedAt.UTC()
+	version.MetadataModified = metadataModified
+
+	versions = append(versions, version)
+	versionsJson, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return version, err
+	}
+	return version, writeFileAtomic(versionsPath(csvPath), versionsJson, 0644)
+}
+
+// files stored before we kept a history become the first version, so the next update does not lose them
+func (s *SnapshotStore) RecordExisting(csvPath string, metadataModified string) error {
+	versions, err := loadVersions(csvPath)
+	if err != nil || len(versions) > 0 {
+		return err
+	}
+	file, err := os.Open(csvPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = s.Record(csvPath, file, fileInfo.ModTime(), metadataModified)
+	return err
+}
+
+func versionsPath(csvPath string) string {
+	return strings.TrimSuffix(csvPath, ".csv") + ".versions.json"
+}
+
+// oldest first
+func loadVersions(csvPath string) ([]SnapshotVersion, error) {
+	var versions []SnapshotVersion
+	data, err := os.ReadFile(versionsPath(csvPath))
+	if os.IsNotExist(err) {
+		return versions, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &versions)
+	return versions, err
+}
+
+type lineCounter struct {
+	lines   int
+	size    int64
+	endedNL bool
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	c.lines += bytes.Count(p, []byte("\n"))
+	c.size += int64(len(p))
+	if len(p) > 0 {
+		c.endedNL = p[len(p)-1] == '\n'
+	}
+	return len(p), nil
+}
+
+// data rows, without the header
+func (c *lineCounter) rows() int {
+	lines := c.lines
+	if c.size > 0 && !c.endedNL {
+		lines++
+	}
+	return max(lines-1, 0)
+}
+
+// lines of the new file that were not in the old one
+func diffLines(oldfile []byte, newfile []byte) []string {
+	oldlines := strings.Split(string(oldfile), "\n")
+	newlines := strings.Split(string(newfile), "\n")
+	var diff []string
+
+	hashmap := make(map[string]struct{}, len(oldlines))
+	for _, line := range oldlines {
+		hashmap[line] = struct{}{}
+	}
+
+	for _, line := range newlines {
+		if _, ok := hashmap[line]; !ok {
+			diff = append(diff, line)
+		}
+	}
+	return diff
+}
+
+// the only names we put on disk, whatever the api hands us could be empty, ../ or worse
+var safePathComponent = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,127}$`)
+
+// the attributes that let the log lines of one resource be picked out of a run
+func resourceLogger(datapackage FileResultItem, resource Resource) *slog.Logger {
+	return slog.With("resource", resource.Id, "package", datapackage.Id, "org", datapackage.Organization.Name)
+}
+
+// the directory under data/ a dataset is stored in, organizations without a usable name are stored under their id
+func storageOrganization(datapackage FileResultItem) (string, error) {
+	if safePathComponent.MatchString(datapackage.Organization.Name) {
+		return datapackage.Organization.Name, nil
+	}
+	if safePathComponent.MatchString(datapackage.Organization.Id) {
+		return datapackage.Organization.Id, nil
+	}
+	return "", fmt.Errorf("dataset %q has neither a usable organization name %q nor id %q", datapackage.Id, datapackage.Organization.Name, datapackage.Organization.Id)
+}
+
+// every resource csv path is built here, unusable ids are rejected rather than cleaned up so two resources never end up in one file
+func resourceCsvPath(datapackage FileResultItem, resource Resource) (string, error) {
+	organization, err := storageOrganization(datapackage)
+	if err != nil {
+		return "", err
+	}
+	if organization != datapackage.Organization.Name {
+		slog.Warn("Organization name is not usable as a path", "package", datapackage.Id, "org", datapackage.Organization.Name, "stored_under", organization)
+	}
+	if !safePathComponent.MatchString(datapackage.Id) {
+		return "", fmt.Errorf("dataset id %q is not usable as a path", datapackage.Id)
+	}
+	if !safePathComponent.MatchString(resource.Id) {
+		return "", fmt.Errorf("resource id %q is not usable as a path", resource.Id)
+	}
+	return filepath.Join("data", organization, datapackage.Id, resource.Id+".csv"), nil
+}
+
+// the organization directory a resource csv is stored under, this is what the state keeps
+func organizationDir(csvPath string) string {
+	return filepath.Base(filepath.Dir(filepath.Dir(csvPath)))
+}
+
+// bootstrap download of a single resource straight to disk
+func (w *Worker) fetchResource(ctx context.Context, datapackage FileResultItem, resource Resource) error {
+	csvPath, err := resourceCsvPath(datapackage, resource)
+	if err != nil {
+		return &ResourceError{Category: FailureMetadata, Err: err}
+	}
+	dirpath := filepath.Dir(csvPath)
+	// create all directories
+	err = os.MkdirAll(dirpath, 0755)
+	if err != nil {
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+	logger := resourceLogger(datapackage, resource)
+	partPath := csvPath + ".part"
+	err = w.download(ctx, logger, datapackage, resource, partPath)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(partPath)
+	if err != nil {
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+	// stored the way updateResource stores it, otherwise the first update diffs utf-8 against the raw download
+	content, err = w.decode(logger, content)
+	if err != nil {
+		return err
+	}
+	version, err := w.snapshots.Record(csvPath, bytes.NewReader(content), time.Now(), resource.MetadataModified)
+	if err != nil {
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+	w.report.addSnapshot(version)
+	if w.keepCsv {
+		w.report.addKeptCsv(version.Size)
+		err = writeFileAtomic(csvPath, content, 0644)
+		if err != nil {
+			return &ResourceError{Category: FailureStorage, Err: err}
+		}
+	}
+	err = os.Remove(partPath)
+	if err != nil {
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+	// a message still owed for the resource stays in the outbox, only the retry is done with
+	resourceState, _ := w.state.Get(resource.Id)
+	resourceState.PackageId = datapackage.Id
+	resourceState.Organization = organizationDir(csvPath)
+	resourceState.OrganizationName = datapackage.Organization.Name
+	resourceState.MetadataModified = resource.MetadataModified
+	resourceState.UpdatedAt = time.Now().UTC()
+	resourceState.SHA256 = version.SHA256
+	resourceState.Retry = nil
+	resourceState.Evicted = false
+	err = w.state.Put(resource.Id, resourceState)
+	if err != nil {
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+	logger.Info("Downloaded", "name", resource.Name, "bytes", version.Size)
+	return nil
+}
+
+// download the resource into partPath, retrying as the policy says, the metrics get the time of the attempt that went through
+func (w *Worker) download(ctx context.Context, logger *slog.Logger, datapackage FileResultItem, resource Resource, partPath string) error {
+	return w.retryPolicy.Do(ctx, logger, func(ctx context.Context) error {
+		start := time.Now()
+		err := downloadResourcePart(ctx, logger, w.downloader, resource, datapackage, partPath, w.dryRun == nil)
+		if err == nil {
+			w.metrics.addFetched(time.Since(start))
+		}
+		return err
+	})
+}
+
+var ErrRestartDownload = errors.New("partial download can not be resumed")
+
+// what we need to know to pick up a partial download where it stopped, stored next to the .part file
+type PartialDownload struct {
+	Url          string `json:"url"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+	// total size of the resource, -1 when the server did not say
+	Total int64 `json:"total"`
+}
+
+// the size of the part we can resume from, zero when there is nothing usable
+func loadPartialDownload(partPath string, url string) (PartialDownload, int64) {
+	var partial PartialDownload
+	data, err := os.ReadFile(partPath + ".json")
+	if err != nil {
+		return partial, 0
+	}
+	err = json.Unmarshal(data, &partial)
+	if err != nil || partial.Url != url || (partial.ETag == "" && partial.LastModified == "") {
+		return partial, 0
+	}
+	fileInfo, err := os.Stat(partPath)
+	if err != nil {
+		return partial, 0
+	}
+	return partial, fileInfo.Size()
+}
+
+func removePartialDownload(partPath string) {
+	os.Remove(partPath)
+	os.Remove(partPath + ".json")
+}
+
+// "bytes 100-199/200", the total is -1 when it is "*"
+func parseContentRange(value string) (int64, int64, error) {
+	var start, end int64
+	var total string
+	_, err := fmt.Sscanf(value, "bytes %d-%d/%s", &start, &end, &total)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad content range %q", value)
+	}
+	if total == "*" {
+		return start, -1, nil
+	}
+	totalSize, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad content range %q", value)
+	}
+	return start, totalSize, nil
+}
+
+// download the resource into partPath, resuming a previous attempt with a range request when the server allows it
+// the part is left behind when the connection drops so the next attempt only fetches the rest
+// a rejected download is kept in data/quarantine/ when quarantine is set
+func downloadResourcePart(ctx context.Context, logger *slog.Logger, downloader *Downloader, resource Resource, datapackage FileResultItem, partPath string, quarantine bool) error {
+	partial, offset := loadPartialDownload(partPath, resource.Url)
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// the server only honours the range if the resource did not change in the meantime
+		if partial.ETag != "" {
+			header.Set("If-Range", partial.ETag)
+		} else {
+			header.Set("If-Range", partial.LastModified)
+		}
+	}
+	resp, err := downloader.Get(ctx, resource.Url, header)
+	if err != nil {
+		return &ResourceError{Category: FailureRequest, Err: err}
+	}
+	defer resp.Body.Close()
+
+	var file *os.File
+	var body io.Reader = resp.Body
+	total := partial.Total
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		start, rangeTotal, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			removePartialDownload(partPath)
+			return &ResourceError{Category: FailureDownload, Err: fmt.Errorf("%w: asked for byte %d, got %q", ErrRestartDownload, offset, resp.Header.Get("Content-Range"))}
+		}
+		if rangeTotal >= 0 {
+			total = rangeTotal
+		}
+		logger.Info("Resuming download", "name", resource.Name, "offset", offset)
+		file, err = os.OpenFile(partPath, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return &ResourceError{Category: FailureStorage, Err: err}
+		}
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// either we already have all of it or the part is of no use
+		if partial.Total == offset {
+			return nil
+		}
+		removePartialDownload(partPath)
+		return &ResourceError{Category: FailureDownload, Err: ErrRestartDownload}
+	default:
+		if offset > 0 {
+			logger.Info("Server did not resume, downloading from the start", "name", resource.Name)
+		}
+		// look at the start of the body before touching anything on disk
+		bodyReader := bufio.NewReader(resp.Body)
+		sniff, err := bodyReader.Peek(512)
+		if err != nil && err != io.EOF {
+			return &ResourceError{Category: FailureDownload, Err: err}
+		}
+		err = validateDownload(resp, sniff)
+		if err != nil {
+			logger.Warn("Rejected download", "name", resource.Name, "url", resource.Url, "err", err)
+			// a megabyte is plenty to see what went wrong
+			if quarantine {
+				rejected, _ := io.ReadAll(io.LimitReader(bodyReader, 1<<20))
+				quarantineDownload(logger, resource, datapackage, resp, rejected, err)
+			}
+			return &ResourceError{Category: FailureInvalidDownload, Err: err}
+		}
+		body = bodyReader
+		total = resp.ContentLength
+		file, err = os.Create(partPath)
+		if err != nil {
+			return &ResourceError{Category: FailureStorage, Err: err}
+		}
+		// only worth keeping the part around if we can ask for the rest of it later
+		partial = PartialDownload{
+			Url:          resource.Url,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			Total:        total,
+		}
+		if resp.Header.Get("Accept-Ranges") == "bytes" && (partial.ETag != "" || partial.LastModified != "") {
+			partialJson, _ := json.Marshal(partial)
+			err = writeFileAtomic(partPath+".json", partialJson, 0644)
+		} else {
+			err = os.Remove(partPath + ".json")
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			file.Close()
+			return &ResourceError{Category: FailureStorage, Err: err}
+		}
+	}
+
+	_, err = io.Copy(file, body)
+	if err != nil {
+		// the server sometimes closes the socket before we finish reading, keep what we got
+		file.Sync()
+		file.Close()
+		return &ResourceError{Category: FailureDownload, Err: err}
+	}
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+	err = file.Close()
+	if err != nil {
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+
+	// make sure we got all of it
+	fileInfo, err := os.Stat(partPath)
+	if err != nil {
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+	if total >= 0 && fileInfo.Size() < total {
+		return &ResourceError{Category: FailureDownload, Err: fmt.Errorf("%w: got %d of %d bytes", io.ErrUnexpectedEOF, fileInfo.Size(), total)}
+	}
+	if total >= 0 && fileInfo.Size() > total {
+		removePartialDownload(partPath)
+		return &ResourceError{Category: FailureDownload, Err: fmt.Errorf("%w: got %d bytes but expected %d", ErrRestartDownload, fileInfo.Size(), total)}
+	}
+	os.Remove(partPath + ".json")
+	return nil
+}
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// capped exponential backoff, half of it random so retries dont crowd the server
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.MaxDelay
+	// shifting the cap down instead of the base up cannot overflow
+	if attempt >= 1 && attempt <= 63 && p.BaseDelay <= p.MaxDelay>>(attempt-1) {
+		delay = p.BaseDelay << (attempt - 1)
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// call fn until it succeeds, fails with an error that is not worth retrying or runs out of attempts, the retries go to logger
+func (p RetryPolicy) Do(ctx context.Context, logger *slog.Logger, fn func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || ctx.Err() != nil || !isRetryable(err) || attempt >= p.MaxAttempts {
+			return err
+		}
+		delay := p.Backoff(attempt)
+		if retryAfter := retryAfterOf(err); retryAfter > delay {
+			if retryAfter > p.MaxDelay {
+				// not going to hold a worker that long, the next run picks it up
+				return err
+			}
+			delay = retryAfter
+		}
+		logger.Warn("Retrying", "delay", delay.String(), "attempt", attempt+1, "max_attempts", p.MaxAttempts, "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// server errors, rate limiting and dropped connections are worth another try, everything else is not going to change
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var invalidDownload *InvalidDownloadError
+	if errors.As(err, &invalidDownload) {
+		if invalidDownload.StatusCode == 0 {
+			// an error page served with a 200
+			return true
+		}
+		return invalidDownload.StatusCode >= 500 || invalidDownload.StatusCode == http.StatusTooManyRequests || invalidDownload.StatusCode == http.StatusRequestTimeout
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) || errors.Is(err, ErrRestartDownload) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func retryAfterOf(err error) time.Duration {
+	var invalidDownload *InvalidDownloadError
+	if errors.As(err, &invalidDownload) {
+		return invalidDownload.RetryAfter
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	return 0
+}
+
+// Retry-After is either a number of seconds or an http date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	date, err := http.ParseTime(value)
+	if err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// sends notifications one at a time at a pace telegram is happy with, independently of how fast we fetch
+// the payload waits in the state outbox until it is sent so nothing is lost if we stop early
+type Notifier struct {
+	telegram    *TelegramClient
+	interval    time.Duration
+	retryPolicy RetryPolicy
+	state       *StateStore
+	report      *RunReport
+	metrics     *Metrics
+	queue       chan string
+	done        chan struct{}
+}
+
+func NewNotifier(ctx context.Context, telegram *TelegramClient, interval time.Duration, retryPolicy RetryPolicy, state *StateStore, report *RunReport, metrics *Metrics) *Notifier {
+	notifier := &Notifier{
+		telegram:    telegram,
+		interval:    interval,
+		retryPolicy: retryPolicy,
+		state:       state,
+		report:      report,
+		metrics:     metrics,
+		queue:       make(chan string, 4096),
+		done:        make(chan struct{}),
+	}
+	go notifier.run(ctx)
+	return notifier
+}
+
+// queue the outbox entry of the resource for sending
+func (n *Notifier) Enqueue(resourceId string) {
+	select {
+	case n.queue <- resourceId:
+	default:
+		slog.Warn("Notification queue is full, the message stays in the outbox for the next run", "resource", resourceId)
+	}
+}
+
+// wait until everything queued so far is sent
+func (n *Notifier) Close() {
+	close(n.queue)
+	<-n.done
+}
+
+func (n *Notifier) run(ctx context.Context) {
+	defer close(n.done)
+	var lastSent time.Time
+	for resourceId := range n.queue {
+		if ctx.Err() != nil {
+			// whatever is left stays in the outbox
+			continue
+		}
+		resourceState, _ := n.state.Get(resourceId)
+		if resourceState.Outbox == nil {
+			continue
+		}
+		// rate limit so telegram doesnt get mad
+		select {
+		case <-time.After(time.Until(lastSent.Add(n.interval))):
+		case <-ctx.Done():
+			continue
+		}
+		logger := slog.With("resource", resourceId, "package", resourceState.PackageId, "org", resourceState.OrganizationName)
+		err := n.retryPolicy.Do(ctx, logger, func(ctx context.Context) error {
+			return n.telegram.SendMessage(*resourceState.Outbox)
+		})
+		lastSent = time.Now()
+		n.metrics.addNotification("telegram", err)
+		if err == nil {
+			logger.Info("Sent notification")
+		} else {
+			logger.Error("Failed to send notification", "err", err)
+			n.report.addFailure(RunFailure{
+				ResourceId:   resourceId,
+				PackageId:    resourceState.PackageId,
+				Organization: resourceState.Organization,
+				Category:     FailureNotification,
+				Error:        err.Error(),
+			})
+			if isRetryable(err) {
+				// stays in the outbox for the next run
+				continue
+			}
+			// telegram rejected the message itself, sending it again is not going to help
+		}
+		resourceState.Outbox = nil
+		err = n.state.Put(resourceId, resourceState)
+		if err != nil {
+			logger.Error("Failed to clear outbox", "err", err)
+		}
+	}
+}
+
+// find the maximum amount of rows we can fit in from the diff to be under telegram's character limits
+func findSubSliceOfMaxLen(slice []string, maxlen int, prefixLen int) ([]string, int) {
+	var subSlice []string
+	curLen := prefixLen
+	for _, s := range slice {
+		if curLen+len(s) < maxlen {
+			subSlice = append(subSlice, s)
+			curLen += len(s)
+		} else {
+			break
+		}
+	}
+	remainingCount := len(slice) - len(subSlice)
+	return subSlice, remainingCount
+}
+
+func processDiffToPayload(config TelegramConfig, isNewResource bool, diff []string, datapackage FileResultItem, resource Resource) SendMessagePayload {
+	// TODO: if diff length is equal to zero it means there is no difference between the files, therefore dont send a message
+	var prefix string
+	if isNewResource {
+		prefix = "📗 New Resource: "
+	} else {
+		prefix = "📘 Update: "
+	}
+
+	// if its the flight data we will process it differently //TODO: make a more robust system for processing exceptional data
+	isFlightData := false
+	isRegularDiff := true
+	if resource.Id == "e83f763b-b7d7-479e-b172-ae981ddc6de5" {
+		isRegularDiff = false
+		isFlightData = true
+		prefix = "✈ Flights Update: "
+	}
+
+	datasetName := resource.Name
+	var datasetDiff string
+
+	if isRegularDiff {
+		diffSlice, remainingCount := findSubSliceOfMaxLen(diff, config.MessageBudget, len(utf16.Encode([]rune(datasetName))))
+		datasetDiffJoined := strings.Join(diffSlice, "\n")
+
+		if remainingCount == 0 {
+			datasetDiff = datasetDiffJoined
+		} else {
+			datasetDiff = fmt.Sprintf("%s\n... and %d more", datasetDiffJoined, remainingCount)
+		}
+	}
+
+	if isFlightData {
+		departed := make(map[string]int)
+		landed := make(map[string]int)
+		cancelled := make(map[string]int)
+
+		for _, flightEntry := range diff {
+			splitFlightEntry := strings.Split(flightEntry, ",")
+
+			countryName := splitFlightEntry[11]
+			statusString := splitFlightEntry[15]
+
+			switch statusString {
+			case "LANDED":
+				landed[countryName] += 1
+			case "DEPARTED":
+				departed[countryName] += 1
+			case "CANCELED":
+				cancelled[countryName] += 1
+			}
+		}
+
+		var stringArrayToBuildMessage []string
+
+		stringArrayToBuildMessage = append(stringArrayToBuildMessage, "🛫 Departures To:")
+
+		for key, value := range departed {
+			stringArrayToBuildMessage = append(stringArrayToBuildMessage, fmt.Sprintf("%s: %d", key, value))
+		}
+
+		stringArrayToBuildMessage = append(stringArrayToBuildMessage, "🛬 Arrived From:")
+
+		for key, value := range landed {
+			stringArrayToBuildMessage = append(stringArrayToBuildMessage, fmt.Sprintf("%s: %d", key, value))
+		}
+
+		stringArrayToBuildMessage = append(stringArrayToBuildMessage, "❌ Cancelled Flights:")
+
+		for key, value := range cancelled {
+			stringArrayToBuildMessage = append(stringArrayToBuildMessage, fmt.Sprintf("%s: %d", key, value))
+		}
+
+		datasetDiff = strings.Join(stringArrayToBuildMessage, "\n")
+	}
+
+	prefixLen := len(utf16.Encode([]rune(prefix)))
+	datasetNameLen := len(utf16.Encode([]rune(datasetName)))
+	datasetDiffLen := len(utf16.Encode([]rune(datasetDiff)))
+
+	var tagNames []string
+	//var tagOffsets []int
+	//var tagLengths []int
+
+	// parse datapackage tags
+	for _, tag := range datapackage.Tags {
+		tagName := strings.ReplaceAll(tag.DisplayName, " ", "_")
+		tagNames = append(tagNames, fmt.Sprintf("#%s", tagName))
+	}
+
+	tagString := strings.Join(tagNames, " ")
+
+	blockquoteMsgEntity := MessageEntity{
+		Type:   "expandable_blockquote",
+		Offset: prefixLen + datasetNameLen + 2,
+		Length: datasetDiffLen,
+	}
+
+	urllinkMsgEntity := MessageEntity{
+		Type:   "text_link",
+		Url:    fmt.Sprintf("https://data.gov.il/dataset/%s/resource/%s", datapackage.Id, resource.Id),
+		Offset: prefixLen + 1,
+		Length: datasetNameLen,
+	}
+	// send message
+	payload := SendMessagePayload{
+		ChatId: config.ChatId,
+		Text:   strings.Join([]string{prefix, datasetName, datasetDiff, tagString}, "\n"),
+		Entities: []MessageEntity{
+			blockquoteMsgEntity,
+			urllinkMsgEntity,
+		},
+	}
+	return payload
+}
+
+const (
+	FailureMetadata        = "metadata"
+	FailureRequest         = "request"
+	FailureDownload        = "download"
+	FailureInvalidDownload = "invalid_download"
+	FailureEncoding        = "encoding"
+	FailureStorage         = "storage"
+	FailureNotification    = "notification"
+	FailurePanic           = "panic"
+)
+
+type ResourceError struct {
+	Category string
+	Err      error
+}
+
+func (e *ResourceError) Error() string {
+	return e.Category + ": " + e.Err.Error()
+}
+
+func (e *ResourceError) Unwrap() error {
+	return e.Err
+}
+
+func failureCategory(err error) string {
+	var resourceErr *ResourceError
+	if errors.As(err, &resourceErr) {
+		return resourceErr.Category
+	}
+	// anything we did not see coming
+	return FailurePanic
+}
+
+type RunFailure struct {
+	ResourceId   string `json:"resource_id"`
+	PackageId    string `json:"package_id"`
+	Organization string `json:"organization"`
+	Name         string `json:"name"`
+	Url          string `json:"url"`
+	Category     string `json:"category"`
+	Error        string `json:"error"`
+	Attempts     int    `json:"attempts"`
+	// the retry budget is spent, the resource waits for a newer version
+	GaveUp bool `json:"gave_up"`
+}
+
+type RunSkip struct {
+	ResourceId string `json:"resource_id"`
+	PackageId  string `json:"package_id"`
+	Name       string `json:"name"`
+	Reason     string `json:"reason"`
+}
+
+type RunReport struct {
+	mu          sync.Mutex
+	Mode        string    `json:"mode"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Checked     int       `json:"checked"`
+	Updated     int       `json:"updated"`
+	Failed      int       `json:"failed"`
+	Exhausted   int       `json:"exhausted"`
+	Interrupted bool      `json:"interrupted"`
+	// size of the versions recorded in this run and what they take on disk after compression, deltas and deduplication
+	SnapshotBytes      int64          `json:"snapshot_bytes"`
+	StoredBytes        int64          `json:"stored_bytes"`
+	SpaceSaved         int64          `json:"space_saved"`
+	FailuresByCategory map[string]int `json:"failures_by_category"`
+	Failures           []RunFailure   `json:"failures"`
+	// left out by the resource rules
+	Skipped []RunSkip `json:"skipped,omitempty"`
+}
+
+func (r *RunReport) addChecked() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Checked++
+}
+
+func (r *RunReport) addUpdated() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Updated++
+}
+
+func (r *RunReport) addExhausted() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Exhausted++
+}
+
+func (r *RunReport) addSnapshot(version SnapshotVersion) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.SnapshotBytes += version.Size
+	r.StoredBytes += version.StoredSize
+	r.SpaceSaved = r.SnapshotBytes - r.StoredBytes
+}
+
+// the uncompressed copy -keep-csv leaves next to the history takes its space too
+func (r *RunReport) addKeptCsv(size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.StoredBytes += size
+	r.SpaceSaved = r.SnapshotBytes - r.StoredBytes
+}
+
+func (r *RunReport) addSkipped(skip RunSkip) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Skipped = append(r.Skipped, skip)
+}
+
+func (r *RunReport) addFailure(failure RunFailure) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Failed++
+	failure.Error = redactor.Redact(failure.Error)
+	r.FailuresByCategory[failure.Category]++
+	r.Failures = append(r.Failures, failure)
+}
+
+// how many resources every rule left out, the run report has them one by one
+func logSkipped(skipped []RunSkip) {
+	byReason := make(map[string]int)
+	for _, skip := range skipped {
+		byReason[skip.Reason]++
+	}
+	reasons := make([]string, 0, len(byReason))
+	for reason := range byReason {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		slog.Info("Skipped resources", "count", byReason[reason], "reason", reason)
+	}
+}
+
+// written to data/reports/ for every run, data/last_run.json always holds the latest one
+func writeRunReport(report *RunReport) error {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.FinishedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll("data/reports", 0755)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.json", report.Mode, report.StartedAt.Format("20060102T150405Z"))
+	err = writeFileAtomic(filepath.Join("data", "reports", name), data, 0644)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic("data/last_run.json", data, 0644)
+}
+
+// gc reports go next to the run reports, they do not replace data/last_run.json
+func writeGCReport(report *GCReport) error {
+	report.FinishedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll("data/reports", 0755)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("gc-%s.json", report.StartedAt.Format("20060102T150405Z"))
+	return writeFileAtomic(filepath.Join("data", "reports", name), data, 0644)
+}
+
+// cumulative counts over observations, counts[i] is how many were at most buckets[i]
+type Histogram struct {
+	Buckets []float64 `json:"buckets"`
+	Counts  []int64   `json:"counts"`
+	Sum     float64   `json:"sum"`
+	Count   int64     `json:"count"`
+}
+
+func newHistogram(buckets ...float64) Histogram {
+	return Histogram{Buckets: buckets, Counts: make([]int64, len(buckets))}
+}
+
+func (h *Histogram) Observe(value float64) {
+	for i, bound := range h.Buckets {
+		if value <= bound {
+			h.Counts[i]++
+		}
+	}
+	h.Sum += value
+	h.Count++
+}
+
+const metricsPath = "data/metrics.json"
+
+// counters that only ever go up, carried from run to run in data/metrics.json for the monitoring server to serve
+type Metrics struct {
+	mu               sync.Mutex
+	ResourcesChecked int64 `json:"resources_checked"`
+	ResourcesFetched int64 `json:"resources_fetched"`
+	ResourcesChanged int64 `json:"resources_changed"`
+	// by failure category
+	ResourcesFailed map[string]int64 `json:"resources_failed"`
+	DownloadedBytes int64            `json:"downloaded_bytes"`
+	// of every download that went through, retries included
+	DownloadSeconds Histogram `json:"download_seconds"`
+	// lines in the diff of a change, all of them for a new resource
+	DiffLines Histogram `json:"diff_lines"`
+	// by sink
+	NotificationsSent   map[string]int64 `json:"notifications_sent"`
+	NotificationsFailed map[string]int64 `json:"notifications_failed"`
+	TelegramRateLimited int64            `json:"telegram_rate_limited"`
+	// by mode, a run that went through even if some resources failed
+	LastSuccess map[string]time.Time `json:"last_success"`
+	UpdatedAt   time.Time            `json:"updated_at"`
+
+	downloader     *Downloader
+	lastDownloaded int64
+	stop           chan struct{}
+	done           chan struct{}
+}
+
+// the metrics so far, written back every interval and on Close, the bytes downloader reads from now on count towards them
+// only the holder of the run lock may open them
+func openMetrics(downloader *Downloader, interval time.Duration) *Metrics {
+	metrics := &Metrics{
+		ResourcesFailed:     make(map[string]int64),
+		NotificationsSent:   make(map[string]int64),
+		NotificationsFailed: make(map[string]int64),
+		LastSuccess:         make(map[string]time.Time),
+	}
+	data, err := os.ReadFile(metricsPath)
+	if err == nil {
+		err = json.Unmarshal(data, metrics)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		// starting over looks like a restart to prometheus, which copes with counters going back to zero
+		slog.Warn("Failed to load metrics, starting from zero", "path", metricsPath, "err", err)
+	}
+	// the buckets changed, the old counts do not fit them
+	downloadBuckets := []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+	if !slices.Equal(metrics.DownloadSeconds.Buckets, downloadBuckets) || len(metrics.DownloadSeconds.Counts) != len(downloadBuckets) {
+		metrics.DownloadSeconds = newHistogram(downloadBuckets...)
+	}
+	diffBuckets := []float64{1, 5, 10, 50, 100, 500, 1000, 5000, 10000, 50000}
+	if !slices.Equal(metrics.DiffLines.Buckets, diffBuckets) || len(metrics.DiffLines.Counts) != len(diffBuckets) {
+		metrics.DiffLines = newHistogram(diffBuckets...)
+	}
+	metrics.downloader = downloader
+	metrics.lastDownloaded = downloader.downloaded.Load()
+	metrics.stop = make(chan struct{})
+	metrics.done = make(chan struct{})
+	go metrics.flush(interval)
+	return metrics
+}
+
+func (m *Metrics) flush(interval time.Duration) {
+	defer close(m.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.write()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *Metrics) write() {
+	m.mu.Lock()
+	downloaded := m.downloader.downloaded.Load()
+	m.DownloadedBytes += downloaded - m.lastDownloaded
+	m.lastDownloaded = downloaded
+	m.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(m, "", "  ")
+	m.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(metricsPath, data, 0644)
+	}
+	if err != nil {
+		slog.Warn("Failed to write metrics", "err", err)
+	}
+}
+
+// stop writing them every interval and write them one last time
+func (m *Metrics) Close() {
+	close(m.stop)
+	<-m.done
+	m.write()
+}
+
+// every method leaves nil metrics alone, a dry run has none
+func (m *Metrics) update(fn func()) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn()
+}
+
+func (m *Metrics) addChecked() {
+	m.update(func() { m.ResourcesChecked++ })
+}
+
+func (m *Metrics) addFetched(duration time.Duration) {
+	m.update(func() {
+		m.ResourcesFetched++
+		m.DownloadSeconds.Observe(duration.Seconds())
+	})
+}
+
+func (m *Metrics) addChanged(diffLines int) {
+	m.update(func() {
+		m.ResourcesChanged++
+		m.DiffLines.Observe(float64(diffLines))
+	})
+}
+
+func (m *Metrics) addFailed(category string) {
+	m.update(func() { m.ResourcesFailed[category]++ })
+}
+
+func (m *Metrics) addNotification(sink string, err error) {
+	m.update(func() {
+		if err != nil {
+			m.NotificationsFailed[sink]++
+		} else {
+			m.NotificationsSent[sink]++
+		}
+	})
+}
+
+func (m *Metrics) addRateLimited() {
+	m.update(func() { m.TelegramRateLimited++ })
+}
+
+func (m *Metrics) setLastSuccess(mode string) {
+	m.update(func() { m.LastSuccess[mode] = time.Now().UTC() })
+}
+
+// exit codes of every command
+const (
+	exitOK     = 0
+	exitFailed = 1
+	exitUsage  = 2
+	// the run finished but some resources failed, or verify found problems
+	exitIncomplete = 3
+	// stopped by a signal before it was done
+	exitInterrupted = 4
+	// another run holds the lock, EX_TEMPFAIL so cron wrappers can tell it apart from a failure
+	exitLocked = 75
+)
+
+type RunLockInfo struct {
+	Pid       int       `json:"pid"`
+	Host      string    `json:"host"`
+	Mode      string    `json:"mode"`
+	StartedAt time.Time `json:"started_at"`
+	Heartbeat time.Time `json:"heartbeat"`
+}
+
+// keeps two runs off the same data directory, the kernel drops the lock when its process dies so a crash never leaves it stuck
+// the file says who holds it and when they were last alive
+type RunLock struct {
+	file *os.File
+	info RunLockInfo
+	stop chan struct{}
+	done chan struct{}
+}
+
+type LockedError struct {
+	Holder RunLockInfo
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("another run is active: %s started %s by pid %d on %s, last heartbeat %s ago",
+		e.Holder.Mode, e.Holder.StartedAt.Format(time.RFC3339), e.Holder.Pid, e.Holder.Host, time.Since(e.Holder.Heartbeat).Round(time.Second))
+}
+
+func AcquireRunLock(path string, mode string, heartbeat time.Duration) (*RunLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		data, _ := io.ReadAll(file)
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			holder, _ := parseRunLockInfo(data)
+			return nil, &LockedError{Holder: holder}
+		}
+		return nil, err
+	}
+	// a released lock is empty, anything left in it belongs to a run that died
+	data, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if previous, err := parseRunLockInfo(data); err == nil && previous.Pid != 0 {
+		slog.Warn("Taking over a stale run lock", "lock_mode", previous.Mode, "pid", previous.Pid, "host", previous.Host, "heartbeat", previous.Heartbeat)
+	}
+
+	hostname, _ := os.Hostname()
+	lock := &RunLock{
+		file: file,
+		info: RunLockInfo{
+			Pid:       os.Getpid(),
+			Host:      hostname,
+			Mode:      mode,
+			StartedAt: time.Now().UTC(),
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	err = lock.write()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	go lock.beat(heartbeat)
+	return lock, nil
+}
+
+func (l *RunLock) write() error {
+	l.info.Heartbeat = time.Now().UTC()
+	data, err := json.Marshal(l.info)
+	if err != nil {
+		return err
+	}
+	// written over the old content and cut to size after, someone reading it in between never finds it empty
+	_, err = l.file.WriteAt(data, 0)
+	if err != nil {
+		return err
+	}
+	return l.file.Truncate(int64(len(data)))
+}
+
+// the first json value in the file, what follows it is left over from a longer heartbeat being overwritten
+func parseRunLockInfo(data []byte) (RunLockInfo, error) {
+	var info RunLockInfo
+	err := json.NewDecoder(bytes.NewReader(data)).Decode(&info)
+	return info, err
+}
+
+func (l *RunLock) beat(interval time.Duration) {
+	defer close(l.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := l.write()
+			if err != nil {
+				slog.Warn("Failed to update the run lock heartbeat", "err", err)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// the file stays, removing it would let a run that already opened it lock a file nobody else sees
+func (l *RunLock) Release() {
+	close(l.stop)
+	<-l.done
+	l.file.Truncate(0)
+	l.file.Close()
+}
+
+// what happens to the data tree once a run is done, the plain file layout leaves it as it is
+type StorageBackend interface {
+	Commit(mode string, titles map[string]string) error
+}
+
+func NewStorageBackend(kind string, dir string, remote string) (StorageBackend, error) {
+	switch kind {
+	case "files":
+		return FileStorage{}, nil
+	case "git":
+		return &GitStorage{dir: dir, remote: remote}, nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", kind)
+}
+
+type FileStorage struct{}
+
+func (FileStorage) Commit(mode string, titles map[string]string) error {
+	return nil
+}
+
+// keeps the data tree in a git repository with a commit for every run that changed something, optionally pushed to a mirror
+type GitStorage struct {
+	dir    string
+	remote string
+}
+
+// only the datasets and their histories go into the archive
+const gitArchiveIgnore = `/objects/
+/quarantine/
+/reports/
+/state.json
+/state.journal
+/last_run.json
+/packagedata.json
+/run.lock
+/status.json
+/metrics.json
+/events/
+*.part
+*.part.json
+*.tmp
+`
+
+func (g *GitStorage) git(ctx context.Context, stdin string, args ...string) ([]byte, error) {
+	// the data directory is usually a volume owned by someone else, git refuses to touch those otherwise
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", g.dir, "-c", "safe.directory=*"}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=DataSoup",
+		"GIT_AUTHOR_EMAIL=datasoup@localhost",
+		"GIT_COMMITTER_NAME=DataSoup",
+		"GIT_COMMITTER_EMAIL=datasoup@localhost",
+	)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// archives made by an older version get the lines added since, and stop tracking what those lines leave out
+func (g *GitStorage) updateIgnore(ctx context.Context) error {
+	ignorePath := filepath.Join(g.dir, ".gitignore")
+	data, err := os.ReadFile(ignorePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	present := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		present[strings.TrimSpace(line)] = true
+	}
+	var missing []string
+	for _, line := range strings.Split(strings.TrimSpace(gitArchiveIgnore), "\n") {
+		if !present[line] {
+			missing = append(missing, line)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	// lines someone added by hand stay where they are
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	data = append(data, strings.Join(missing, "\n")+"\n"...)
+	err = writeFileAtomic(ignorePath, data, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(g.dir, ".git", "index")); os.IsNotExist(err) {
+		return nil
+	}
+	tracked, err := g.git(ctx, "", "ls-files", "-z", "--cached", "--ignored", "--exclude-standard")
+	if err != nil {
+		return err
+	}
+	if len(tracked) == 0 {
+		return nil
+	}
+	_, err = g.git(ctx, string(tracked), "rm", "-q", "--cached", "--pathspec-from-file=-", "--pathspec-file-nul")
+	return err
+}
+
+func (g *GitStorage) Commit(mode string, titles map[string]string) error {
+	ctx := context.Background()
+	if _, err := os.Stat(filepath.Join(g.dir, ".git")); os.IsNotExist(err) {
+		slog.Info("Creating git archive", "dir", g.dir)
+		_, err = g.git(ctx, "", "init", "-q")
+		if err != nil {
+			return err
+		}
+	}
+	err := g.updateIgnore(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = g.git(ctx, "", "add", "-A")
+	if err != nil {
+		return err
+	}
+	out, err := g.git(ctx, "", "diff", "--cached", "--name-only", "-z")
+	if err != nil {
+		return err
+	}
+	if len(out) == 0 {
+		slog.Info("Nothing changed in the git archive")
+		return nil
+	}
+	changed := make(map[string]bool)
+	for _, path := range strings.Split(string(out), "\x00") {
+		parts := strings.Split(path, "/")
+		if len(parts) >= 3 {
+			changed[parts[0]+"/"+parts[1]] = true
+		}
+	}
+	datasets := make([]string, 0, len(changed))
+	for dataset := range changed {
+		datasets = append(datasets, dataset)
+	}
+	sort.Strings(datasets)
+
+	// the subject counts the datasets, the body lists them with their titles
+	var message strings.Builder
+	fmt.Fprintf(&message, "%s: %d datasets changed\n\n", mode, len(datasets))
+	for _, dataset := range datasets {
+		if title := titles[dataset]; title != "" {
+			fmt.Fprintf(&message, "%s %s\n", dataset, title)
+		} else {
+			fmt.Fprintf(&message, "%s\n", dataset)
+		}
+	}
+	_, err = g.git(ctx, message.String(), "commit", "-q", "-F", "-")
+	if err != nil {
+		return err
+	}
+	slog.Info("Committed to the git archive", "datasets", len(datasets))
+
+	if g.remote != "" {
+		pushCtx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+		defer cancel()
+		_, err = g.git(pushCtx, "", "push", "-q", g.remote, "HEAD")
+		if err != nil {
+			return err
+		}
+		slog.Info("Pushed the git archive", "remote", g.remote)
+	}
+	return nil
+}
+
+// dataset titles for commit messages, keyed like the dataset directories
+func datasetTitles(datafile File) map[string]string {
+	titles := make(map[string]string)
+	for _, datapackage := range datafile.Result.Results {
+		organization, err := storageOrganization(datapackage)
+		if err == nil {
+			titles[organization+"/"+datapackage.Id] = datapackage.Title
+		}
+	}
+	return titles
+}
+
+// everything a normal run needs to check and update a single resource
+type Worker struct {
+	config       *Config
+	downloader   *Downloader
+	notifier     *Notifier
+	charDetector *chardet.Detector
+	retryPolicy  RetryPolicy
+	state        *StateStore
+	snapshots    *SnapshotStore
+	keepCsv      bool
+	refTime      time.Time
+	maxAttempts  int
+	report       *RunReport
+	metrics      *Metrics
+	// set in a dry run, which writes nothing but the messages it would send
+	dryRun *DryRunOutput
+}
+
+type DryRunOutput struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	// scratch space for the downloads
+	dir string
+}
+
+// one json line per message
+func (o *DryRunOutput) Write(event ChangeEvent) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.encoder.Encode(event)
+}
+
+// the error boundary around a single resource, nothing that goes wrong in here may stop the run
+func (w *Worker) checkResource(ctx context.Context, datapackage FileResultItem, resource Resource) (updated bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &ResourceError{Category: FailurePanic, Err: fmt.Errorf("%v", r)}
+		}
+	}()
+
+	resourceState, isTracked := w.state.Get(resource.Id)
+	if resourceState.Retry != nil && resourceState.Retry.MetadataModified == resource.MetadataModified && resourceState.Retry.Attempts >= w.maxAttempts {
+		// already gave up on this version
+		w.report.addExhausted()
+		return false, nil
+	}
+
+	curTime, err := time.Parse("2006-01-02T15:04:05.000000", resource.MetadataModified)
+	if err != nil {
+		return false, &ResourceError{Category: FailureMetadata, Err: err}
+	}
+	csvPath, err := resourceCsvPath(datapackage, resource)
+	if err != nil {
+		return false, &ResourceError{Category: FailureMetadata, Err: err}
+	}
+
+	// resources that failed on a previous run are fetched again regardless of their timestamps
+	isPendingRetry := resourceState.Retry != nil
+
+	var isOutdated bool
+	if isTracked && resourceState.MetadataModified != "" {
+		// we know exactly which version we have, this is what lets a rerun pick up where the last one died
+		isOutdated = resourceState.MetadataModified != resource.MetadataModified
+	} else {
+		// check if the resource file was modified after refTime
+		isFileOlderThanLastUpdate := false
+		fileInfo, err := os.Stat(csvPath)
+		if err != nil {
+			// if the file doesnt exist then we say that its older
+			isFileOlderThanLastUpdate = true
+		} else if fileInfo.ModTime().Before(w.refTime) {
+			isFileOlderThanLastUpdate = true
+		}
+		isOutdated = curTime.After(w.refTime) && isFileOlderThanLastUpdate
+	}
+
+	if !isOutdated && !isPendingRetry {
+		return false, nil
+	}
+
+	return true, w.updateResource(ctx, datapackage, resource, csvPath)
+}
+
+// the download as utf-8, everything stored goes through here so versions compare byte for byte
+func (w *Worker) decode(logger *slog.Logger, body []byte) ([]byte, error) {
+	// detect encoding
+	result, err := w.charDetector.DetectBest(body)
+	if err != nil {
+		return nil, &ResourceError{Category: FailureEncoding, Err: err}
+	}
+	logger.Debug("Detected encoding", "charset", result.Charset)
+	// if charset is ISO-8859-8 or ISO-8859-8-I then convert from windows1255 to utf8
+	if result.Charset != "UTF-8" {
+		decoder := charmap.Windows1255.NewDecoder()
+		body, err = decoder.Bytes(body)
+		if err != nil {
+			return nil, &ResourceError{Category: FailureEncoding, Err: err}
+		}
+	}
+	return body, nil
+}
+
+func (w *Worker) updateResource(ctx context.Context, datapackage FileResultItem, resource Resource, csvPath string) error {
+	logger := resourceLogger(datapackage, resource)
+	logger.Info("Updating", "name", resource.Name, "url", resource.Url, "metadata_modified", resource.MetadataModified)
+	// fetch updated next to the good copy, an error page never gets past downloadResourcePart
+	partPath := csvPath + ".part"
+	if w.dryRun != nil {
+		partPath = filepath.Join(w.dryRun.dir, resource.Id+".part")
+	} else {
+		err := os.MkdirAll(filepath.Dir(csvPath), 0755)
+		if err != nil {
+			return &ResourceError{Category: FailureStorage, Err: err}
+		}
+	}
+	err := w.download(ctx, logger, datapackage, resource, partPath)
+	if err != nil {
+		return err
+	}
+	newfilebody, err := os.ReadFile(partPath)
+	if err != nil {
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+	newfilebody, err = w.decode(logger, newfilebody)
+	if err != nil {
+		return err
+	}
+
+	var payload SendMessagePayload
+	previousState, _ := w.state.Get(resource.Id)
+	oldfile, isNewResource, err := w.previousContent(logger, csvPath, previousState)
+	if err != nil {
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+	var previousHash string
+	if !isNewResource {
+		sum := sha256.Sum256(oldfile)
+		previousHash = hex.EncodeToString(sum[:])
+	}
+	if isNewResource && previousState.Evicted {
+		// nothing left to diff against, this is no more new than it was before gc
+		return w.reseedResource(logger, datapackage, resource, csvPath, partPath, newfilebody)
+	}
+	diff := changeLines(isNewResource, oldfile, newfilebody)
+	logger.Debug("Rendering the change", "new", isNewResource, "previous_sha256", previousHash, "diff_lines", len(diff))
+	payload = processDiffToPayload(w.config.Telegram, isNewResource, diff, datapackage, resource)
+	if w.dryRun != nil {
+		removePartialDownload(partPath)
+		sum := sha256.Sum256(newfilebody)
+		err = w.dryRun.Write(newChangeEvent(datapackage, resource, isNewResource, previousHash, hex.EncodeToString(sum[:]), payload))
+		if err != nil {
+			return &ResourceError{Category: FailureStorage, Err: err}
+		}
+		logger.Info("Would announce", "new", isNewResource)
+		return nil
+	}
+
+	// keep the version we are about to overwrite if it predates the history
+	err = w.snapshots.RecordExisting(csvPath, previousState.MetadataModified)
+	if err != nil {
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+	version, err := w.snapshots.Record(csvPath, bytes.NewReader(newfilebody), time.Now(), resource.MetadataModified)
+	if err != nil {
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+	w.report.addSnapshot(version)
+
+	// overwrite file, then commit it to the state together with the notification it owes
+	if w.keepCsv {
+		w.report.addKeptCsv(version.Size)
+		err = writeFileAtomic(csvPath, newfilebody, 0644)
+	} else {
+		err = os.Remove(csvPath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+	os.Remove(partPath)
+	resourceState := ResourceState{
+		PackageId:        datapackage.Id,
+		Organization:     organizationDir(csvPath),
+		OrganizationName: datapackage.Organization.Name,
+		MetadataModified: resource.MetadataModified,
+		UpdatedAt:        time.Now().UTC(),
+		SHA256:           version.SHA256,
+		Outbox:           &payload,
+	}
+	err = w.state.Put(resource.Id, resourceState)
+	if err != nil {
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+	err = writeChangeEvent(newChangeEvent(datapackage, resource, isNewResource, previousHash, version.SHA256, payload))
+	if err != nil {
+		logger.Warn("Failed to write change event", "err", err)
+	}
+	w.metrics.addChanged(len(diff))
+	logger.Info("Updated", "new", isNewResource, "sha256", version.SHA256, "bytes", version.Size)
+
+	// the outbox entry stays in the state until the message went out, the next run sends it otherwise
+	w.notifier.Enqueue(resource.Id)
+	return nil
+}
+
+// store a resource gc evicted again as the start of its history, without a message
+func (w *Worker) reseedResource(logger *slog.Logger, datapackage FileResultItem, resource Resource, csvPath string, partPath string, content []byte) error {
+	if w.dryRun != nil {
+		removePartialDownload(partPath)
+		logger.Info("Would store again without announcing, gc evicted it")
+		return nil
+	}
+	version, err := w.snapshots.Record(csvPath, bytes.NewReader(content), time.Now(), resource.MetadataModified)
+	if err != nil {
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+	w.report.addSnapshot(version)
+	if w.keepCsv {
+		w.report.addKeptCsv(version.Size)
+		err = writeFileAtomic(csvPath, content, 0644)
+		if err != nil {
+			return &ResourceError{Category: FailureStorage, Err: err}
+		}
+	}
+	os.Remove(partPath)
+	// a message owed from before the eviction is still in the notifier's hands
+	current, _ := w.state.Get(resource.Id)
+	err = w.state.Put(resource.Id, ResourceState{
+		PackageId:        datapackage.Id,
+		Organization:     organizationDir(csvPath),
+		OrganizationName: datapackage.Organization.Name,
+		MetadataModified: resource.MetadataModified,
+		UpdatedAt:        time.Now().UTC(),
+		SHA256:           version.SHA256,
+		Outbox:           current.Outbox,
+	})
+	if err != nil {
+		return &ResourceError{Category: FailureStorage, Err: err}
+	}
+	logger.Info("Stored again without announcing, gc evicted it", "sha256", version.SHA256, "bytes", version.Size)
+	return nil
+}
+
+// the message for a change, the same whether it goes out now or is rendered again from the stored versions later
+func renderChange(config TelegramConfig, isNew bool, oldfile []byte, newfile []byte, datapackage FileResultItem, resource Resource) SendMessagePayload {
+	return processDiffToPayload(config, isNew, changeLines(isNew, oldfile, newfile), datapackage, resource)
+}
+
+// what a message shows of a change, every line of a new resource
+func changeLines(isNew bool, oldfile []byte, newfile []byte) []string {
+	if isNew {
+		return strings.Split(string(newfile), "\n")
+	}
+	// run diffing TODO: Dont publish message if there is no difference in the resource
+	return diffLines(oldfile, newfile)
+}
+
+// a change we announced, kept in data/events/ so it can be looked at and sent again later
+type ChangeEvent struct {
+	Id    string    `json:"id"`
+	Time  time.Time `json:"time"`
+	IsNew bool      `json:"is_new"`
+	// the dataset without its resources
+	Package        FileResultItem     `json:"package"`
+	Resource       Resource           `json:"resource"`
+	PreviousSHA256 string             `json:"previous_sha256,omitempty"`
+	SHA256         string             `json:"sha256"`
+	Payload        SendMessagePayload `json:"payload"`
+}
+
+func newChangeEvent(datapackage FileResultItem, resource Resource, isNew bool, previousHash string, hash string, payload SendMessagePayload) ChangeEvent {
+	now := time.Now().UTC()
+	datapackage.Resources = nil
+	return ChangeEvent{
+		Id:             now.Format("20060102T150405Z") + "-" + resource.Id,
+		Time:           now,
+		IsNew:          isNew,
+		Package:        datapackage,
+		Resource:       resource,
+		PreviousSHA256: previousHash,
+		SHA256:         hash,
+		Payload:        payload,
+	}
+}
+
+func writeChangeEvent(event ChangeEvent) error {
+	err := os.MkdirAll(filepath.Join("data", "events"), 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(event, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join("data", "events", event.Id+".json"), data, 0644)
+}
+
+// the ids of the events from since on, oldest first
+func listChangeEvents(since time.Time) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join("data", "events"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		// the id starts with the time of the event
+		at, err := time.Parse("20060102T150405Z", strings.SplitN(id, "-", 2)[0])
+		if err != nil || at.Before(since) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// the message of the event as the current templates and processors render it
+func (s *SnapshotStore) rerender(config TelegramConfig, event ChangeEvent) (SendMessagePayload, error) {
+	newfile, err := s.Read(event.SHA256)
+	if err != nil {
+		return SendMessagePayload{}, err
+	}
+	var oldfile []byte
+	if !event.IsNew {
+		oldfile, err = s.Read(event.PreviousSHA256)
+		if err != nil {
+			return SendMessagePayload{}, err
+		}
+	}
+	return renderChange(config, event.IsNew, oldfile, newfile, event.Package, event.Resource), nil
+}
+
+func loadChangeEvent(id string) (ChangeEvent, error) {
+	var event ChangeEvent
+	if !safePathComponent.MatchString(id) {
+		return event, fmt.Errorf("%q is not an event id", id)
+	}
+	data, err := os.ReadFile(filepath.Join("data", "events", id+".json"))
+	if err != nil {
+		return event, err
+	}
+	err = json.Unmarshal(data, &event)
+	return event, err
+}
+
+// the version we diff against, from the snapshot store when we have it there and from the csv otherwise
+func (w *Worker) previousContent(logger *slog.Logger, csvPath string, resourceState ResourceState) ([]byte, bool, error) {
+	if resourceState.SHA256 != "" {
+		content, err := w.snapshots.Read(resourceState.SHA256)
+		if err == nil {
+			return content, false, nil
+		}
+		logger.Warn("Failed to read stored version, diffing against the csv", "sha256", resourceState.SHA256, "err", err)
+	}
+	content, err := os.ReadFile(csvPath)
+	if os.IsNotExist(err) {
+		return nil, true, nil
+	}
+	return content, false, err
+}
+
+// count the failure against the retry budget of the resource and add it to the run report
+func (w *Worker) recordFailure(datapackage FileResultItem, resource Resource, err error) {
+	category := failureCategory(err)
+	logger := resourceLogger(datapackage, resource)
+	logger.Error("Failed to update", "name", resource.Name, "category", category, "err", err)
+
+	failure := RunFailure{
+		ResourceId:   resource.Id,
+		PackageId:    datapackage.Id,
+		Organization: datapackage.Organization.Name,
+		Name:         resource.Name,
+		Url:          resource.Url,
+		Category:     category,
+		Error:        err.Error(),
+	}
+
+	w.metrics.addFailed(category)
+	// the file is already stored and the outbox sends the message on the next run, no need to fetch again
+	if category != FailureNotification && w.dryRun == nil {
+		resourceState, _ := w.state.Get(resource.Id)
+		resourceState.PackageId = datapackage.Id
+		resourceState.OrganizationName = datapackage.Organization.Name
+		if organization, err := storageOrganization(datapackage); err == nil {
+			resourceState.Organization = organization
+		}
+		attempts := 1
+		if resourceState.Retry != nil && resourceState.Retry.MetadataModified == resource.MetadataModified {
+			attempts = resourceState.Retry.Attempts + 1
+		}
+		resourceState.Retry = &RetryEntry{
+			Category:         category,
+			Reason:           err.Error(),
+			Since:            time.Now().UTC(),
+			Attempts:         attempts,
+			MetadataModified: resource.MetadataModified,
+		}
+		stateErr := w.state.Put(resource.Id, resourceState)
+		if stateErr != nil {
+			logger.Error("Failed to record retry", "err", stateErr)
+		}
+		failure.Attempts = attempts
+		failure.GaveUp = attempts >= w.maxAttempts
+	}
+
+	w.report.addFailure(failure)
+}
+
+// where the csv of a resource lives, resources stored before we tracked state are looked up on disk
+func findResourceCsv(state *StateStore, resourceId string) (string, error) {
+	if !safePathComponent.MatchString(resourceId) {
+		return "", fmt.Errorf("%q is not a resource id", resourceId)
+	}
+	resourceState, ok := state.Get(resourceId)
+	if ok && resourceState.PackageId != "" {
+		return filepath.Join("data", resourceState.Organization, resourceState.PackageId, resourceId+".csv"), nil
+	}
+	matches, err := filepath.Glob(filepath.Join("data", "*", "*", resourceId+".csv"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("resource %s is not stored", resourceId)
+	}
+	return matches[0], nil
+}
+
+// accepts RFC 3339 or a plain date
+func parseTimeArg(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// list the stored versions of a resource, oldest first
+func listVersions(state *StateStore, resourceId string) error {
+	csvPath, err := findResourceCsv(state, resourceId)
+	if err != nil {
+		return err
+	}
+	versions, err := loadVersions(csvPath)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		fmt.Printf("%s\t%s\t%s\t%d bytes\t%d rows\n", version.FetchedAt.Format(time.RFC3339), version.MetadataModified, version.SHA256, version.Size, version.Rows)
+	}
+	return nil
+}
+
+// the index of the version we had at the given time, the latest one when no time is given
+func selectVersion(versions []SnapshotVersion, at string) (int, error) {
+	if len(versions) == 0 {
+		return 0, errors.New("no stored versions")
+	}
+	if at == "" {
+		return len(versions) - 1, nil
+	}
+	atTime, err := parseTimeArg(at)
+	if err != nil {
+		return 0, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !versions[i].FetchedAt.After(atTime) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no version from before %s", at)
+}
+
+// how much history gc keeps, a version is kept if either rule wants it and the latest one always is
+type RetentionPolicy struct {
+	KeepVersions int
+	KeepDays     int
+	// bytes the datasets, their history and the state may take, datasets that were updated least recently go first
+	Quota int64
+	// rejected downloads in data/quarantine/ older than this are deleted, 0 keeps them
+	QuarantineDays int
+}
+
+// what gc never frees, so it does not count against the quota either
+var gcUncounted = []string{".git", "quarantine", "reports", "events"}
+
+func (p RetentionPolicy) keep(versions []SnapshotVersion, now time.Time) ([]SnapshotVersion, []SnapshotVersion) {
+	if p.KeepVersions <= 0 && p.KeepDays <= 0 {
+		return versions, nil
+	}
+	var kept, pruned []SnapshotVersion
+	for i, version := range versions {
+		fromEnd := len(versions) - i
+		if fromEnd == 1 ||
+			(p.KeepVersions > 0 && fromEnd <= p.KeepVersions) ||
+			(p.KeepDays > 0 && version.FetchedAt.After(now.AddDate(0, 0, -p.KeepDays))) {
+			kept = append(kept, version)
+		} else {
+			pruned = append(pruned, version)
+		}
+	}
+	return kept, pruned
+}
+
+type GCPrunedVersion struct {
+	Path      string    `json:"path"`
+	SHA256    string    `json:"sha256"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+type GCEvictedDataset struct {
+	Path      string    `json:"path"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Size      int64     `json:"size"`
+}
+
+type GCReport struct {
+	DryRun          bool               `json:"dry_run"`
+	StartedAt       time.Time          `json:"started_at"`
+	FinishedAt      time.Time          `json:"finished_at"`
+	UsedBytes       int64              `json:"used_bytes"`
+	FreedBytes      int64              `json:"freed_bytes"`
+	Quota           int64              `json:"quota"`
+	PrunedVersions  []GCPrunedVersion  `json:"pruned_versions"`
+	EvictedDatasets []GCEvictedDataset `json:"evicted_datasets"`
+	DeletedObjects  int                `json:"deleted_objects"`
+	// quarantined files past the quarantine retention, their bytes are not part of the quota
+	DeletedQuarantined   int   `json:"deleted_quarantined"`
+	QuarantineFreedBytes int64 `json:"quarantine_freed_bytes"`
+}
+
+// a dataset directory as gc sees it
+type gcDataset struct {
+	dir       string
+	updatedAt time.Time
+	size      int64
+	// resource csv path to the versions it keeps, only for resources that lose some
+	kept    map[string][]SnapshotVersion
+	objects map[string]bool
+}
+
+// the base a delta object is stored against, empty for full objects
+func (s *SnapshotStore) base(hash string) (string, error) {
+	file, err := os.Open(s.objectPath(hash))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	magic := make([]byte, 2)
+	_, err = io.ReadFull(file, magic)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		// empty or stored before compression
+		return "", nil
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return "", err
+	}
+	header := make([]byte, 1+sha256.Size*2)
+	n, err := io.ReadFull(zr, header)
+	if n > 0 && header[0] == objectDelta {
+		if err != nil {
+			return "", fmt.Errorf("object %s is cut short", hash)
+		}
+		return string(header[1:]), nil
+	}
+	if n == 0 && err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// mark every object a dataset still needs, including the bases of its deltas
+func (s *SnapshotStore) mark(hash string, marked map[string]bool) {
+	for hash != "" && !marked[hash] {
+		marked[hash] = true
+		base, err := s.base(hash)
+		if err != nil {
+			slog.Warn("Failed to read object", "sha256", hash, "err", err)
+			return
+		}
+		hash = base
+	}
+}
+
+// apply the retention policy and the quota, dry runs only report what would go
+func collectGarbage(state *StateStore, snapshots *SnapshotStore, policy RetentionPolicy, dryRun bool) (*GCReport, error) {
+	now := time.Now().UTC()
+	report := &GCReport{DryRun: dryRun, StartedAt: now, Quota: policy.Quota}
+
+	// everything under data counts against the quota, except what only gc itself could free
+	err := filepath.WalkDir("data", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			for _, name := range gcUncounted {
+				if path == filepath.Join("data", name) {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		report.UsedBytes += fileInfo.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// every dataset directory holds csvs, version histories or both
+	datasets := make(map[string]*gcDataset)
+	for _, pattern := range []string{"*.csv", "*.versions.json"} {
+		matches, err := filepath.Glob(filepath.Join("data", "*", "*", pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			dir := filepath.Dir(match)
+			if datasets[dir] == nil {
+				datasets[dir] = &gcDataset{dir: dir, kept: make(map[string][]SnapshotVersion), objects: make(map[string]bool)}
+			}
+		}
+	}
+
+	objectRefs := make(map[string]int)
+	for _, dataset := range datasets {
+		entries, err := os.ReadDir(dataset.dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			fileInfo, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			if entry.IsDir() {
+				continue
+			}
+			dataset.size += fileInfo.Size()
+			if strings.HasSuffix(entry.Name(), ".csv") && fileInfo.ModTime().After(dataset.updatedAt) {
+				dataset.updatedAt = fileInfo.ModTime()
+			}
+			if !strings.HasSuffix(entry.Name(), ".versions.json") {
+				continue
+			}
+			csvPath := filepath.Join(dataset.dir, strings.TrimSuffix(entry.Name(), ".versions.json")+".csv")
+			versions, err := loadVersions(csvPath)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", versionsPath(csvPath), err)
+			}
+			kept, pruned := policy.keep(versions, now)
+			if len(pruned) > 0 {
+				dataset.kept[csvPath] = kept
+			}
+			for _, version := range pruned {
+				report.PrunedVersions = append(report.PrunedVersions, GCPrunedVersion{Path: csvPath, SHA256: version.SHA256, FetchedAt: version.FetchedAt})
+			}
+			for _, version := range kept {
+				snapshots.mark(version.SHA256, dataset.objects)
+				if version.FetchedAt.After(dataset.updatedAt) {
+					dataset.updatedAt = version.FetchedAt
+				}
+			}
+		}
+		for hash := range dataset.objects {
+			objectRefs[hash]++
+		}
+	}
+
+	// anything in the store no dataset points at is garbage
+	objectSizes := make(map[string]int64)
+	err = filepath.WalkDir(snapshots.dir, func(path string, entry fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipAll
+		}
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		name := entry.Name()
+		// leftovers of an object that was never committed, unless a run is writing it right now
+		if strings.HasPrefix(name, ".object.") && fileInfo.ModTime().Before(now.Add(-24*time.Hour)) {
+			objectSizes[path] = fileInfo.Size()
+		} else if len(name) == sha256.Size*2 {
+			objectSizes[name] = fileInfo.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	used := report.UsedBytes
+	for hash, size := range objectSizes {
+		if objectRefs[hash] == 0 {
+			used -= size
+		}
+	}
+
+	// still too big, drop whole datasets starting with the one that has not changed for the longest
+	if policy.Quota > 0 && used > policy.Quota {
+		byAge := make([]*gcDataset, 0, len(datasets))
+		for _, dataset := range datasets {
+			byAge = append(byAge, dataset)
+		}
+		sort.Slice(byAge, func(i, j int) bool {
+			return byAge[i].updatedAt.Before(byAge[j].updatedAt)
+		})
+		for _, dataset := range byAge {
+			if used <= policy.Quota {
+				break
+			}
+			used -= dataset.size
+			for hash := range dataset.objects {
+				objectRefs[hash]--
+				if objectRefs[hash] == 0 {
+					used -= objectSizes[hash]
+				}
+			}
+			report.EvictedDatasets = append(report.EvictedDatasets, GCEvictedDataset{Path: dataset.dir, UpdatedAt: dataset.updatedAt, Size: dataset.size})
+			// its versions are going away with it
+			delete(datasets, dataset.dir)
+		}
+		if used > policy.Quota {
+			slog.Warn("Still over the quota after evicting every dataset", "used_bytes", used, "quota", policy.Quota)
+		}
+	}
+	report.FreedBytes = report.UsedBytes - used
+
+	for _, pruned := range report.PrunedVersions {
+		slog.Info("Pruning", "path", pruned.Path, "fetched_at", pruned.FetchedAt, "sha256", pruned.SHA256, "dry_run", dryRun)
+	}
+	for _, evicted := range report.EvictedDatasets {
+		slog.Info("Evicting", "path", evicted.Path, "updated_at", evicted.UpdatedAt, "bytes", evicted.Size, "dry_run", dryRun)
+	}
+	for hash := range objectSizes {
+		if objectRefs[hash] == 0 {
+			report.DeletedObjects++
+		}
+	}
+	// every rejected attempt of every run leaves its response here, only the recent ones are worth looking at
+	var quarantined []string
+	if policy.QuarantineDays > 0 {
+		entries, err := os.ReadDir(filepath.Join("data", "quarantine"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			fileInfo, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			if entry.IsDir() || !fileInfo.ModTime().Before(now.AddDate(0, 0, -policy.QuarantineDays)) {
+				continue
+			}
+			quarantined = append(quarantined, filepath.Join("data", "quarantine", entry.Name()))
+			report.DeletedQuarantined++
+			report.QuarantineFreedBytes += fileInfo.Size()
+		}
+	}
+	if dryRun {
+		slog.Info("Would free", "freed_bytes", report.FreedBytes, "used_bytes", report.UsedBytes, "deleted_objects", report.DeletedObjects, "deleted_quarantined", report.DeletedQuarantined)
+		return report, nil
+	}
+
+	// histories first, so being stopped half way leaves unreferenced objects and never missing ones
+	for _, dataset := range datasets {
+		for csvPath, kept := range dataset.kept {
+			versionsJson, err := json.MarshalIndent(kept, "", "  ")
+			if err != nil {
+				return report, err
+			}
+			err = writeFileAtomic(versionsPath(csvPath), versionsJson, 0644)
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+	for _, evicted := range report.EvictedDatasets {
+		err := os.RemoveAll(evicted.Path)
+		if err != nil {
+			return report, err
+		}
+		// drop the organization too once it has no datasets left
+		os.Remove(filepath.Dir(evicted.Path))
+	}
+	// the stored versions of evicted resources are gone, only a message that is still owed survives them
+	for resourceId, resourceState := range state.All() {
+		dir := filepath.Join("data", resourceState.Organization, resourceState.PackageId)
+		for _, evicted := range report.EvictedDatasets {
+			if evicted.Path == dir && !resourceState.Evicted {
+				err := state.Put(resourceId, ResourceState{
+					PackageId:        resourceState.PackageId,
+					Organization:     resourceState.Organization,
+					OrganizationName: resourceState.OrganizationName,
+					Outbox:           resourceState.Outbox,
+					Evicted:          true,
+				})
+				if err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+	for hash := range objectSizes {
+		if objectRefs[hash] > 0 {
+			continue
+		}
+		path := hash
+		if len(hash) == sha256.Size*2 {
+			path = snapshots.objectPath(hash)
+		}
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return report, err
+		}
+	}
+	for _, path := range quarantined {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return report, err
+		}
+	}
+	slog.Info("Freed", "freed_bytes", report.FreedBytes, "used_bytes", report.UsedBytes, "deleted_objects", report.DeletedObjects, "deleted_quarantined", report.DeletedQuarantined)
+	return report, state.Compact()
+}
+
+// which resources a bootstrap downloads, empty lists do not filter
+type BootstrapFilter struct {
+	Window               time.Duration
+	Organizations        []string
+	ExcludeOrganizations []string
+	Tags                 []string
+	ExcludeTags          []string
+	Formats              []string
+	// bytes, resources that do not say how big they are are not held to it
+	MaxSize int
+	// only these resource ids regardless of the window, to retry what failed last time
+	Resources []string
+}
+
+// whether the bootstrap downloads the resource, and why not if it does not
+func (f BootstrapFilter) Match(datapackage FileResultItem, resource Resource, now time.Time) (bool, string) {
+	if len(f.Resources) > 0 {
+		if containsFold(f.Resources, resource.Id) {
+			return true, ""
+		}
+		return false, "resource"
+	}
+	if len(f.Formats) > 0 && !containsFold(f.Formats, resource.Format) {
+		return false, "format"
+	}
+	metadataTime, err := time.Parse("2006-01-02T15:04:05.000000", resource.MetadataModified)
+	if err != nil {
+		return false, "bad metadata_modified"
+	}
+	if !metadataTime.After(now.Add(-f.Window)) {
+		return false, "outside the window"
+	}
+	if len(f.Organizations) > 0 && !containsFold(f.Organizations, datapackage.Organization.Name) {
+		return false, "organization"
+	}
+	if containsFold(f.ExcludeOrganizations, datapackage.Organization.Name) {
+		return false, "excluded organization"
+	}
+	if len(f.Tags) > 0 && !hasTag(datapackage, f.Tags) {
+		return false, "tag"
+	}
+	if hasTag(datapackage, f.ExcludeTags) {
+		return false, "excluded tag"
+	}
+	if f.MaxSize > 0 && resource.Size > f.MaxSize {
+		return false, "too big"
+	}
+	return true, ""
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// tags are matched on their name or how they are displayed
+func hasTag(datapackage FileResultItem, tags []string) bool {
+	for _, tag := range datapackage.Tags {
+		if containsFold(tags, tag.Name) || containsFold(tags, tag.DisplayName) {
+			return true
+		}
+	}
+	return false
+}
+
+// a comma separated flag value
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// how far a long run got, printed every few seconds
+type Progress struct {
+	mu            sync.Mutex
+	downloader    *Downloader
+	total         int
+	done          int
+	expectedBytes int64
+	startBytes    int64
+	startedAt     time.Time
+}
+
+func NewProgress(downloader *Downloader, jobs []DownloadJob) *Progress {
+	progress := &Progress{
+		downloader: downloader,
+		total:      len(jobs),
+		startBytes: downloader.downloaded.Load(),
+		startedAt:  time.Now(),
+	}
+	for _, job := range jobs {
+		progress.expectedBytes += int64(job.Resource.Size)
+	}
+	return progress
+}
+
+func (p *Progress) Done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+}
+
+// numbers rather than a sentence, so they can be graphed straight from the log
+func (p *Progress) LogValue() slog.Value {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elapsed := time.Since(p.startedAt)
+	downloaded := p.downloader.downloaded.Load() - p.startBytes
+	throughput := float64(downloaded) / max(elapsed.Seconds(), 1)
+	attrs := []slog.Attr{
+		slog.Int("done", p.done),
+		slog.Int("total", p.total),
+		slog.Int64("downloaded_bytes", downloaded),
+		slog.Int64("bytes_per_second", int64(throughput)),
+		slog.Int64("elapsed_seconds", int64(elapsed.Seconds())),
+	}
+	// by bytes when the catalogue told us how big things are, by resources otherwise
+	var eta time.Duration
+	if p.expectedBytes > downloaded && throughput > 0 {
+		eta = time.Duration(float64(p.expectedBytes-downloaded) / throughput * float64(time.Second))
+	} else if p.done > 0 && p.done < p.total {
+		eta = elapsed / time.Duration(p.done) * time.Duration(p.total-p.done)
+	}
+	if eta > 0 && p.done < p.total {
+		attrs = append(attrs, slog.Int64("eta_seconds", int64(eta.Seconds())))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func (p *Progress) Print(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			slog.Info("Progress", "progress", p)
+		case <-done:
+			return
+		}
+	}
+}
+
+// everything a bootstrap or a normal run needs that stays the same from one run to the next
+type Runner struct {
+	config          *Config
+	downloader      *Downloader
+	retryPolicy     RetryPolicy
+	snapshots       *SnapshotStore
+	storage         StorageBackend
+	keepCsv         bool
+	maxAttempts     int
+	notifyInterval  time.Duration
+	bootstrapFilter BootstrapFilter
+}
+
+var (
+	ErrInterrupted = errors.New("run interrupted")
+	// the run went through but some resources failed, the report has them
+	ErrIncomplete = errors.New("finished with failures")
+)
+
+// the whole catalogue, as it came from the api and parsed
+func fetchPackageData() ([]byte, File, error) {
+	var datafile File
+	// Get json from datagov
+	resp, err := http.Post("https://data.gov.il/api/3/action/package_search", "application/json", strings.NewReader(`{"rows": 99999}`))
+	if err != nil {
+		return nil, datafile, err
+	}
+	// read response body into memory
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, datafile, err
+	}
+
+	// unmarsal json to struct
+	json.Unmarshal(data, &datafile)
+	if datafile.Success == false {
+		return nil, datafile, fmt.Errorf("failed to fetch datafile: %s", resp.Status)
+	}
+	return data, datafile, nil
+}
+
+// download everything that changed recently, stop stops handing out resources and ctx cancels the ones in progress
+func (r *Runner) Bootstrap(ctx context.Context, stop context.Context) error {
+	slog.Info("Bootstrapping data files")
+	state, err := loadState("data/state.json")
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+	metrics := openMetrics(r.downloader, 30*time.Second)
+	defer metrics.Close()
+	data, datafile, err := fetchPackageData()
+	if err != nil {
+		return err
+	}
+
+	planned, _ := r.bootstrapJobs(datafile)
+	// every resource is checkpointed in the state as soon as it is stored, an interrupted bootstrap picks up from there
+	var jobs []DownloadJob
+	for _, job := range planned {
+		resourceState, ok := state.Get(job.Resource.Id)
+		if ok && resourceState.SHA256 != "" && resourceState.MetadataModified == job.Resource.MetadataModified {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	if len(jobs) < len(planned) {
+		slog.Info("Resuming", "already_downloaded", len(planned)-len(jobs), "planned", len(planned))
+	}
+	slog.Info("Downloading", "resources", len(jobs))
+	report := &RunReport{
+		Mode:               "bootstrap",
+		StartedAt:          time.Now().UTC(),
+		Checked:            len(planned),
+		FailuresByCategory: make(map[string]int),
+	}
+	worker := &Worker{
+		config:      r.config,
+		downloader:  r.downloader,
+		retryPolicy: r.retryPolicy,
+		state:       state,
+		snapshots:   r.snapshots,
+		keepCsv:     r.keepCsv,
+		report:      report,
+		metrics:     metrics,
+	}
+	progress := NewProgress(r.downloader, jobs)
+	progressDone := make(chan struct{})
+	go progress.Print(10*time.Second, progressDone)
+	complete := r.downloader.Run(ctx, stop.Done(), jobs, func(ctx context.Context, job DownloadJob) {
+		defer progress.Done()
+		metrics.addChecked()
+		err := worker.fetchResource(ctx, job.Package, job.Resource)
+		if err != nil {
+			metrics.addFailed(failureCategory(err))
+			resourceLogger(job.Package, job.Resource).Error("Giving up", "name", job.Resource.Name, "category", failureCategory(err), "err", err)
+			report.addFailure(RunFailure{
+				ResourceId:   job.Resource.Id,
+				PackageId:    job.Package.Id,
+				Organization: job.Package.Organization.Name,
+				Name:         job.Resource.Name,
+				Url:          job.Resource.Url,
+				Category:     failureCategory(err),
+				Error:        err.Error(),
+			})
+			return
+		}
+		report.addUpdated()
+	})
+	close(progressDone)
+	report.Interrupted = !complete || ctx.Err() != nil
+
+	// the summary, with what it takes to retry the failures one by one
+	if report.Interrupted {
+		slog.Warn("Downloads interrupted, run bootstrap again to fetch the rest", "progress", progress)
+	} else {
+		slog.Info("Downloads finished", "progress", progress, "downloaded", report.Updated, "already_there", len(planned)-len(jobs), "failed", report.Failed)
+	}
+	if len(report.Failures) > 0 {
+		var failedIds []string
+		for _, failure := range report.Failures {
+			failedIds = append(failedIds, failure.ResourceId)
+		}
+		slog.Warn("Retry the failed resources with ./main bootstrap -resources", "resources", strings.Join(failedIds, ","))
+	}
+	err = writeRunReport(report)
+	if err != nil {
+		slog.Error("Failed to write run report", "err", err)
+	}
+	err = r.storage.Commit("bootstrap", datasetTitles(datafile))
+	if err != nil {
+		slog.Error("Failed to archive the data tree", "err", err)
+	}
+	err = state.Compact()
+	if err != nil {
+		return err
+	}
+
+	// only a finished bootstrap becomes the baseline, until then a run bootstraps again instead of comparing against it
+	if report.Interrupted {
+		return ErrInterrupted
+	}
+	// retrying a few resources leaves the baseline alone, moving it would hide what changed since the last run
+	_, err = os.Stat("data/packagedata.json")
+	if len(r.bootstrapFilter.Resources) == 0 || os.IsNotExist(err) {
+		// write json response to file
+		err = writeFileAtomic("data/packagedata.json", data, 0644)
+		if err != nil {
+			return err
+		}
+		if report.Checked == 0 || report.Failed < report.Checked {
+			metrics.setLastSuccess("bootstrap")
+		}
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%w: %d of %d resources failed", ErrIncomplete, report.Failed, len(jobs))
+	}
+	return nil
+}
+
+// the resources the bootstrap filter lets through, along with how many were left out for which reason
+func (r *Runner) bootstrapJobs(datafile File) ([]DownloadJob, map[string]int) {
+	var jobs []DownloadJob
+	skipped := make(map[string]int)
+	now := time.Now()
+	for _, datapackage := range datafile.Result.Results {
+		for _, resource := range datapackage.Resources {
+			ok, reason := r.bootstrapFilter.Match(datapackage, resource, now)
+			if ok {
+				// a bootstrap leaves out what runs would not follow either
+				ok, reason = r.config.Resources.Match(datapackage, resource)
+			}
+			if !ok {
+				skipped[reason]++
+				continue
+			}
+			jobs = append(jobs, DownloadJob{Package: datapackage, Resource: resource})
+		}
+	}
+	return jobs, skipped
+}
+
+// what a bootstrap would download right now, without downloading it
+func (r *Runner) Plan() error {
+	_, datafile, err := fetchPackageData()
+	if err != nil {
+		return err
+	}
+	jobs, skipped := r.bootstrapJobs(datafile)
+
+	var totalSize int64
+	unknownSize := 0
+	byOrganization := make(map[string]int64)
+	for _, job := range jobs {
+		if job.Resource.Size <= 0 {
+			unknownSize++
+		}
+		totalSize += int64(job.Resource.Size)
+		byOrganization[job.Package.Organization.Name] += int64(job.Resource.Size)
+	}
+	organizations := make([]string, 0, len(byOrganization))
+	for organization := range byOrganization {
+		organizations = append(organizations, organization)
+	}
+	sort.Slice(organizations, func(i, j int) bool {
+		return byOrganization[organizations[i]] > byOrganization[organizations[j]]
+	})
+
+	fmt.Println("Bootstrap would download", len(jobs), "resources,", totalSize, "bytes")
+	if unknownSize > 0 {
+		fmt.Println(unknownSize, "of them do not say how big they are")
+	}
+	for _, organization := range organizations {
+		fmt.Printf("  %s\t%d bytes\n", organization, byOrganization[organization])
+	}
+	reasons := make([]string, 0, len(skipped))
+	for reason := range skipped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Println("Skipped", skipped[reason], "resources:", reason)
+	}
+	return nil
+}
+
+// check every resource against the catalogue from the last run, store and announce what changed
+func (r *Runner) Update(ctx context.Context, stop context.Context) error {
+	// nothing to compare against yet, take the current catalogue as the baseline without announcing all of it
+	if _, err := os.Stat("data/packagedata.json"); os.IsNotExist(err) {
+		slog.Info("No previous run found, this run only bootstraps and the next one publishes what changed since", "window", r.bootstrapFilter.Window.String())
+		// a bad token should show up now rather than a whole bootstrap later
+		telegram, err := NewTelegramClient(r.config)
+		if err != nil {
+			return err
+		}
+		err = telegram.GetMe()
+		if err != nil {
+			return err
+		}
+		return r.Bootstrap(ctx, stop)
+	}
+
+	slog.Info("Running normally")
+	metrics := openMetrics(r.downloader, 30*time.Second)
+	defer metrics.Close()
+	telegram, err := NewTelegramClient(r.config)
+	if err != nil {
+		return err
+	}
+	telegram.metrics = metrics
+	// check that it works
+	err = telegram.GetMe()
+	if err != nil {
+		return err
+	}
+
+	refTime, err := previousRunTime()
+	if err != nil {
+		return err
+	}
+
+	state, err := loadState("data/state.json")
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+	report := &RunReport{
+		Mode:               "run",
+		StartedAt:          time.Now().UTC(),
+		FailuresByCategory: make(map[string]int),
+	}
+
+	// messages that did not go out before we were told to stop stay in the outbox
+	notifier := NewNotifier(stop, telegram, r.notifyInterval, r.retryPolicy, state, report, metrics)
+	// send whatever was committed but not sent before the last run died
+	for resourceId, resourceState := range state.Pending() {
+		slog.Info("Sending leftover notification", "resource", resourceId, "package", resourceState.PackageId, "org", resourceState.OrganizationName)
+		notifier.Enqueue(resourceId)
+	}
+
+	newDatafileBody, newDatafile, err := fetchPackageData()
+	if err != nil {
+		notifier.Close()
+		return err
+	}
+
+	worker := &Worker{
+		config:       r.config,
+		downloader:   r.downloader,
+		notifier:     notifier,
+		charDetector: chardet.NewTextDetector(),
+		retryPolicy:  r.retryPolicy,
+		state:        state,
+		snapshots:    r.snapshots,
+		keepCsv:      r.keepCsv,
+		refTime:      refTime,
+		maxAttempts:  r.maxAttempts,
+		report:       report,
+		metrics:      metrics,
+	}
+
+	jobs := r.updateJobs(newDatafile, report)
+	complete := r.downloader.Run(ctx, stop.Done(), jobs, func(ctx context.Context, job DownloadJob) {
+		metrics.addChecked()
+		updated, err := worker.checkResource(ctx, job.Package, job.Resource)
+		if err != nil {
+			worker.recordFailure(job.Package, job.Resource, err)
+		} else if updated {
+			report.addUpdated()
+		}
+	})
+	notifier.Close()
+
+	slog.Info("Checked every resource", "updated", report.Updated, "checked", report.Checked, "failed", report.Failed)
+	report.Interrupted = !complete || ctx.Err() != nil
+	err = writeRunReport(report)
+	if err != nil {
+		slog.Error("Failed to write run report", "err", err)
+	}
+	err = r.storage.Commit("run", datasetTitles(newDatafile))
+	if err != nil {
+		slog.Error("Failed to archive the data tree", "err", err)
+	}
+	if report.Interrupted {
+		// keep the old packagedata.json so the next run still sees everything we did not get to
+		err = state.Compact()
+		if err != nil {
+			slog.Error("Failed to compact state", "err", err)
+		}
+		return ErrInterrupted
+	}
+	slog.Info("Done updating, overwriting packagedata.json")
+	// overwrite packagedata.json
+	err = writeFileAtomic("data/packagedata.json", newDatafileBody, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = state.Compact()
+	if err != nil {
+		return err
+	}
+	// a run where every resource failed did not get through, whatever the reason
+	if report.Checked == 0 || report.Failed < report.Checked {
+		metrics.setLastSuccess("run")
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%w: %d of %d resources failed", ErrIncomplete, report.Failed, report.Checked)
+	}
+	return nil
+}
+
+// when the catalogue we compare against was current, from the newest dataset in data/packagedata.json
+func previousRunTime() (time.Time, error) {
+	// Parse previous file for last modified date
+	data, err := os.ReadFile("data/packagedata.json")
+	if err != nil {
+		return time.Time{}, err
+	}
+	var datafile File
+	json.Unmarshal(data, &datafile)
+	if len(datafile.Result.Results) == 0 {
+		return time.Time{}, errors.New("data/packagedata.json has no datasets")
+	}
+	refTime, err := time.Parse("2006-01-02T15:04:05.000000", datafile.Result.Results[0].MetadataModified) // wtf golang time parsing ಠ_ಠ
+	if err != nil {
+		return time.Time{}, err
+	}
+	slog.Debug("Comparing against the previous catalogue", "ref_time", refTime)
+	return refTime, nil
+}
+
+// the resources a run checks, what the rules leave out goes into the report
+func (r *Runner) updateJobs(datafile File, report *RunReport) []DownloadJob {
+	var jobs []DownloadJob
+	for _, datapackage := range datafile.Result.Results {
+		for _, resource := range datapackage.Resources {
+			if resource.Size >= r.config.Download.MaxResourceSize { // is it not too big
+				continue
+			}
+			ok, reason := r.config.Resources.Match(datapackage, resource)
+			if !ok {
+				report.addSkipped(RunSkip{
+					ResourceId: resource.Id,
+					PackageId:  datapackage.Id,
+					Name:       resource.Name,
+					Reason:     reason,
+				})
+				continue
+			}
+			report.addChecked()
+			jobs = append(jobs, DownloadJob{Package: datapackage, Resource: resource})
+		}
+
+	}
+	logSkipped(report.Skipped)
+	return jobs
+}
+
+// fetch and diff like a run, but only write the messages it would send to out
+// the data directory is left as it is, so it can run next to the worker without the lock
+func (r *Runner) DryRun(ctx context.Context, stop context.Context, out io.Writer) error {
+	if _, err := os.Stat("data/packagedata.json"); os.IsNotExist(err) {
+		return errors.New("no previous run to compare against, bootstrap first")
+	}
+	slog.Info("Dry run, nothing is stored or sent")
+	refTime, err := previousRunTime()
+	if err != nil {
+		return err
+	}
+	state, err := peekState("data/state.json")
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "datasoup-dry-run-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	report := &RunReport{
+		Mode:               "dry-run",
+		StartedAt:          time.Now().UTC(),
+		FailuresByCategory: make(map[string]int),
+	}
+
+	_, newDatafile, err := fetchPackageData()
+	if err != nil {
+		return err
+	}
+	worker := &Worker{
+		config:       r.config,
+		downloader:   r.downloader,
+		charDetector: chardet.NewTextDetector(),
+		retryPolicy:  r.retryPolicy,
+		state:        state,
+		snapshots:    r.snapshots,
+		keepCsv:      r.keepCsv,
+		refTime:      refTime,
+		maxAttempts:  r.maxAttempts,
+		report:       report,
+		dryRun:       &DryRunOutput{encoder: json.NewEncoder(out), dir: dir},
+	}
+	jobs := r.updateJobs(newDatafile, report)
+	complete := r.downloader.Run(ctx, stop.Done(), jobs, func(ctx context.Context, job DownloadJob) {
+		updated, err := worker.checkResource(ctx, job.Package, job.Resource)
+		if err != nil {
+			worker.recordFailure(job.Package, job.Resource, err)
+		} else if updated {
+			report.addUpdated()
+		}
+	})
+
+	slog.Info("Checked every resource", "would_send", report.Updated, "checked", report.Checked, "failed", report.Failed)
+	if !complete || ctx.Err() != nil {
+		return ErrInterrupted
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%w: %d of %d resources failed", ErrIncomplete, report.Failed, report.Checked)
+	}
+	return nil
+}
+
+// every line logged until end is called carries the id of the run, a process never has two runs going at once
+func startRun(mode string) (runId string, end func()) {
+	runId = fmt.Sprintf("%016x", rand.Uint64())
+	previous := slog.Default()
+	slog.SetDefault(previous.With("run_id", runId, "mode", mode))
+	return runId, func() { slog.SetDefault(previous) }
+}
+
+// run fn while holding the run lock
+func withRunLock(mode string, fn func() error) error {
+	err := os.MkdirAll("data", 0755)
+	if err != nil {
+		return err
+	}
+	lock, err := AcquireRunLock("data/run.lock", mode, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	return fn()
+}
+
+// the first signal stops handing out resources and lets the ones in progress finish, a second one cancels those too
+func signalContexts() (context.Context, context.Context) {
+	stop, stopCancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		slog.Warn("Stopping after the resources in progress, signal again to stop right away")
+		stopCancel()
+		<-signals
+		slog.Warn("Stopping right away")
+		cancel()
+	}()
+	return stop, ctx
+}
+
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+type IntervalSchedule time.Duration
+
+func (s IntervalSchedule) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(s))
+}
+
+// a standard five field cron expression, minute hour day-of-month month day-of-week, in local time
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// like cron, when both day fields are restricted a day matching either one is enough
+	domAny, dowAny bool
+}
+
+func ParseCronSchedule(expr string) (*CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q needs 5 fields, has %d", expr, len(fields))
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]uint64
+	for i, field := range fields {
+		for _, part := range strings.Split(field, ",") {
+			rangePart, stepPart, hasStep := strings.Cut(part, "/")
+			step := 1
+			if hasStep {
+				var err error
+				step, err = strconv.Atoi(stepPart)
+				if err != nil || step <= 0 {
+					return nil, fmt.Errorf("cron expression %q has a bad step in %q", expr, part)
+				}
+			}
+			low, high := bounds[i][0], bounds[i][1]
+			if rangePart != "*" {
+				lowPart, highPart, isRange := strings.Cut(rangePart, "-")
+				var err error
+				low, err = strconv.Atoi(lowPart)
+				if err != nil {
+					return nil, fmt.Errorf("cron expression %q has a bad value in %q", expr, part)
+				}
+				if isRange {
+					high, err = strconv.Atoi(highPart)
+					if err != nil {
+						return nil, fmt.Errorf("cron expression %q has a bad value in %q", expr, part)
+					}
+				} else if !hasStep {
+					high = low
+				}
+			}
+			if low < bounds[i][0] || high > bounds[i][1] || low > high {
+				return nil, fmt.Errorf("cron expression %q is out of range in %q", expr, part)
+			}
+			for value := low; value <= high; value += step {
+				sets[i] |= 1 << uint(value)
+			}
+		}
+	}
+	// sunday is both 0 and 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &CronSchedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// the first matching minute after the given time, zero if the expression never matches
+func (c *CronSchedule) Next(after time.Time) time.Time {
+	location := after.Location()
+	t := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute(), 0, 0, location).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, location)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, location)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, location)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (c *CronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// what the worker is doing right now, written to data/status.json for the monitoring server
+type WorkerStatus struct {
+	// running, idle, finished, failed or stopped
+	State    string `json:"state"`
+	Mode     string `json:"mode"`
+	Pid      int    `json:"pid"`
+	Daemon   bool   `json:"daemon"`
+	Schedule string `json:"schedule,omitempty"`
+	// of the current or last run, what its log lines carry
+	RunId         string     `json:"run_id,omitempty"`
+	RunStartedAt  time.Time  `json:"run_started_at"`
+	RunFinishedAt time.Time  `json:"run_finished_at"`
+	NextRunAt     *time.Time `json:"next_run_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+func writeWorkerStatus(status *WorkerStatus) {
+	status.UpdatedAt = time.Now().UTC()
+	status.LastError = redactor.Redact(status.LastError)
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err == nil {
+		err = writeFileAtomic("data/status.json", data, 0644)
+	}
+	if err != nil {
+		slog.Warn("Failed to write worker status", "err", err)
+	}
+}
+
+// run the update on the schedule until told to stop, a run that fails or finds the lock taken waits for the next turn
+func runDaemon(ctx context.Context, stop context.Context, runner *Runner, schedule Schedule, scheduleName string, next time.Time) {
+	status := &WorkerStatus{
+		Mode:     "run",
+		Pid:      os.Getpid(),
+		Daemon:   true,
+		Schedule: scheduleName,
+	}
+	// the status file belongs to whoever holds the lock, a run we were locked out by keeps it
+	lockedOut := false
+	for {
+		status.State = "idle"
+		status.NextRunAt = &next
+		if !lockedOut {
+			writeWorkerStatus(status)
+		}
+		slog.Info("Waiting for the next run", "next_run_at", next)
+		select {
+		case <-time.After(time.Until(next)):
+		case <-stop.Done():
+			status.State = "stopped"
+			status.NextRunAt = nil
+			writeWorkerStatus(status)
+			return
+		}
+
+		startedAt := time.Now()
+		runId, end := startRun("run")
+		err := withRunLock("run", func() error {
+			status.State = "running"
+			status.RunId = runId
+			status.RunStartedAt = startedAt.UTC()
+			status.NextRunAt = nil
+			writeWorkerStatus(status)
+			err := runner.Update(ctx, stop)
+			status.RunFinishedAt = time.Now().UTC()
+			status.LastError = ""
+			if err != nil {
+				status.LastError = err.Error()
+			}
+			return err
+		})
+		var lockedErr *LockedError
+		lockedOut = errors.As(err, &lockedErr)
+		if err != nil {
+			slog.Error("Run failed", "err", err)
+		}
+		end()
+		if stop.Err() != nil {
+			status.State = "stopped"
+			status.NextRunAt = nil
+			writeWorkerStatus(status)
+			return
+		}
+
+		// a run that took longer than the interval is followed by the next one right away
+		next = schedule.Next(startedAt)
+		if next.Before(time.Now()) {
+			next = time.Now()
+		}
+	}
+}
+
+// settings that stay the same from run to run, from datasoup.yaml with environment variables on top
+type Config struct {
+	Telegram   TelegramConfig   `yaml:"telegram"`
+	Download   DownloadConfig   `yaml:"download"`
+	Monitoring MonitoringConfig `yaml:"monitoring"`
+	Log        LogConfig        `yaml:"log"`
+	// which resources are followed at all
+	Resources ResourceRules `yaml:"resources"`
+
+	// where it was loaded from, empty when there was no file
+	path string
+}
+
+type TelegramConfig struct {
+	Token string `yaml:"token"`
+	// read when no token is set, the way the token was kept before there was a config file
+	TokenFile string `yaml:"token_file"`
+	// a @channel name or a numeric chat id
+	ChatId string `yaml:"chat_id"`
+	// utf-16 code units of diff in a message, telegram allows 4096 for the whole text
+	MessageBudget int `yaml:"message_budget"`
+}
+
+type DownloadConfig struct {
+	UserAgent string `yaml:"user_agent"`
+	// bytes, a run does not follow bigger resources
+	MaxResourceSize int `yaml:"max_resource_size"`
+	// 0 for no limit
+	MaxConnsPerHost int `yaml:"max_conns_per_host"`
+	// how long a server may take to start answering, and to send more of a body, before the attempt fails and is retried
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+	IdleTimeout           time.Duration `yaml:"idle_timeout"`
+}
+
+type MonitoringConfig struct {
+	Port int `yaml:"port"`
+	// how long ago the last successful run may have been before /readyz fails
+	MaxRunAge time.Duration `yaml:"max_run_age"`
+}
+
+type LogConfig struct {
+	// debug, info, warn or error
+	Level string `yaml:"level"`
+	// json for machines, text for people
+	Format string `yaml:"format"`
+}
+
+// a resource is followed when it matches one of the allow rules, or there are none, and none of the deny rules
+type ResourceRules struct {
+	Allow []ResourceRule `yaml:"allow"`
+	// win over the allow rules
+	Deny []ResourceRule `yaml:"deny"`
+}
+
+// matches a resource when every condition that is set does, the lists match any of their values
+type ResourceRule struct {
+	// how the rule is called in the output and the run report, its conditions when it has no name
+	Name          string   `yaml:"name,omitempty"`
+	Ids           []string `yaml:"ids,omitempty"`
+	Organizations []string `yaml:"orgs,omitempty"`
+	Tags          []string `yaml:"tags,omitempty"`
+	Formats       []string `yaml:"formats,omitempty"`
+	// bytes, 0 leaves that end open, a resource that does not say how big it is is outside every range
+	MinSize int `yaml:"min_size,omitempty"`
+	MaxSize int `yaml:"max_size,omitempty"`
+	// a regular expression for the resource name
+	NamePattern string `yaml:"name_pattern,omitempty"`
+	// the update frequency of the resource, or of its dataset when the resource has none
+	Frequencies []string `yaml:"frequencies,omitempty"`
+
+	namePattern *regexp.Regexp
+}
+
+func defaultConfig() Config {
+	return Config{
+		Telegram: TelegramConfig{
+			TokenFile:     ".telegram_token",
+			ChatId:        "@datasoup",
+			MessageBudget: 3800,
+		},
+		Download: DownloadConfig{
+			UserAgent:             "github.com/wissotsky#datagov-external-client",
+			MaxResourceSize:       200_000_000,
+			MaxConnsPerHost:       50,
+			ResponseHeaderTimeout: time.Minute,
+			IdleTimeout:           time.Minute,
+		},
+		Monitoring: MonitoringConfig{
+			Port:      8080,
+			MaxRunAge: 24 * time.Hour,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Resources: ResourceRules{
+			// allow rules in the config replace it, add CSV to their formats to stay with csv
+			Allow: []ResourceRule{{
+				Name:    "csv",
+				Formats: []string{"CSV"},
+			}},
+			Deny: []ResourceRule{{
+				Name: "exempt",
+				Ids: []string{
+					"053cea08-09bc-40ec-8f7a-156f0677aff3",
+					"aba233c2-6a5a-487d-b0a8-9413ef849f15",
+				},
+			}},
+		},
+	}
+}
+
+// $DATASOUP_CONFIG, or datasoup.yaml in the working directory
+func configPath() string {
+	path := os.Getenv("DATASOUP_CONFIG")
+	if path == "" {
+		path = "datasoup.yaml"
+	}
+	return path
+}
+
+// the defaults, overridden by the file if there is one and then by the environment
+func loadConfig(path string) (*Config, error) {
+	config := defaultConfig()
+	data, err := os.ReadFile(path)
+	if err == nil {
+		config.path = path
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		// a misspelled key would otherwise be ignored without a word
+		decoder.KnownFields(true)
+		err = decoder.Decode(&config)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	envErr := config.applyEnv()
+	if config.Telegram.Token == "" && config.Telegram.TokenFile != "" {
+		token, err := os.ReadFile(config.Telegram.TokenFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		config.Telegram.Token = strings.TrimSpace(string(token))
+	}
+	err = errors.Join(envErr, config.validate())
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func validChatId(chatId string) bool {
+	_, err := strconv.ParseInt(chatId, 10, 64)
+	return err == nil || (strings.HasPrefix(chatId, "@") && len(chatId) > 1)
+}
+
+// an empty variable counts as unset, compose passes TELEGRAM_TOKEN=${TELEGRAM_TOKEN} along even when it is not set on the host
+func lookupEnv(name string) (string, bool) {
+	value := os.Getenv(name)
+	return value, value != ""
+}
+
+func (c *Config) applyEnv() error {
+	var errs []error
+	envString := func(name string, target *string) {
+		if value, ok := lookupEnv(name); ok {
+			*target = value
+		}
+	}
+	envInt := func(name string, target *int) {
+		if value, ok := lookupEnv(name); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a number", name, value))
+				return
+			}
+			*target = n
+		}
+	}
+	envDuration := func(name string, target *time.Duration) {
+		if value, ok := lookupEnv(name); ok {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a duration", name, value))
+				return
+			}
+			*target = duration
+		}
+	}
+	envString("TELEGRAM_TOKEN", &c.Telegram.Token)
+	envString("DATASOUP_TELEGRAM_TOKEN_FILE", &c.Telegram.TokenFile)
+	envString("DATASOUP_TELEGRAM_CHAT_ID", &c.Telegram.ChatId)
+	envInt("DATASOUP_TELEGRAM_MESSAGE_BUDGET", &c.Telegram.MessageBudget)
+	envString("DATASOUP_DOWNLOAD_USER_AGENT", &c.Download.UserAgent)
+	envInt("DATASOUP_DOWNLOAD_MAX_RESOURCE_SIZE", &c.Download.MaxResourceSize)
+	envInt("DATASOUP_DOWNLOAD_MAX_CONNS_PER_HOST", &c.Download.MaxConnsPerHost)
+	envDuration("DATASOUP_DOWNLOAD_RESPONSE_HEADER_TIMEOUT", &c.Download.ResponseHeaderTimeout)
+	envDuration("DATASOUP_DOWNLOAD_IDLE_TIMEOUT", &c.Download.IdleTimeout)
+	envInt("DATASOUP_MONITORING_PORT", &c.Monitoring.Port)
+	envDuration("DATASOUP_MONITORING_MAX_RUN_AGE", &c.Monitoring.MaxRunAge)
+	envString("DATASOUP_LOG_LEVEL", &c.Log.Level)
+	envString("DATASOUP_LOG_FORMAT", &c.Log.Format)
+	return errors.Join(errs...)
+}
+
+// every problem at once rather than one per attempt
+func (c *Config) validate() error {
+	var errs []error
+	if !validChatId(c.Telegram.ChatId) {
+		errs = append(errs, fmt.Errorf("telegram.chat_id %q is neither a @channel nor a numeric chat id", c.Telegram.ChatId))
+	}
+	if c.Telegram.MessageBudget < 1 || c.Telegram.MessageBudget > 4096 {
+		errs = append(errs, fmt.Errorf("telegram.message_budget %d has to be between 1 and 4096", c.Telegram.MessageBudget))
+	}
+	if c.Download.UserAgent == "" {
+		errs = append(errs, errors.New("download.user_agent is empty"))
+	}
+	if c.Download.MaxResourceSize <= 0 {
+		errs = append(errs, fmt.Errorf("download.max_resource_size %d has to be positive", c.Download.MaxResourceSize))
+	}
+	if c.Download.MaxConnsPerHost < 0 {
+		errs = append(errs, fmt.Errorf("download.max_conns_per_host %d can not be negative", c.Download.MaxConnsPerHost))
+	}
+	if c.Download.ResponseHeaderTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("download.response_header_timeout %s has to be positive", c.Download.ResponseHeaderTimeout))
+	}
+	if c.Download.IdleTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("download.idle_timeout %s has to be positive", c.Download.IdleTimeout))
+	}
+	if c.Monitoring.Port < 1 || c.Monitoring.Port > 65535 {
+		errs = append(errs, fmt.Errorf("monitoring.port %d is not a port", c.Monitoring.Port))
+	}
+	if c.Monitoring.MaxRunAge <= 0 {
+		errs = append(errs, fmt.Errorf("monitoring.max_run_age %s has to be positive", c.Monitoring.MaxRunAge))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log.level %q is none of debug, info, warn and error", c.Log.Level))
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		errs = append(errs, fmt.Errorf("log.format %q is neither json nor text", c.Log.Format))
+	}
+	for i := range c.Resources.Allow {
+		errs = append(errs, c.Resources.Allow[i].compile(fmt.Sprintf("resources.allow[%d]", i)))
+	}
+	for i := range c.Resources.Deny {
+		errs = append(errs, c.Resources.Deny[i].compile(fmt.Sprintf("resources.deny[%d]", i)))
+	}
+	return errors.Join(errs...)
+}
+
+// check the rule and get it ready for matching
+func (r *ResourceRule) compile(where string) error {
+	if len(r.Ids) == 0 && len(r.Organizations) == 0 && len(r.Tags) == 0 && len(r.Formats) == 0 &&
+		r.MinSize == 0 && r.MaxSize == 0 && r.NamePattern == "" && len(r.Frequencies) == 0 {
+		// it would match everything, most likely a mistake in the indentation
+		return fmt.Errorf("%s has no conditions", where)
+	}
+	if r.MinSize < 0 || r.MaxSize < 0 || (r.MaxSize > 0 && r.MinSize > r.MaxSize) {
+		return fmt.Errorf("%s has a bad size range %d to %d", where, r.MinSize, r.MaxSize)
+	}
+	if r.NamePattern != "" {
+		var err error
+		r.namePattern, err = regexp.Compile(r.NamePattern)
+		if err != nil {
+			return fmt.Errorf("%s: %v", where, err)
+		}
+	}
+	return nil
+}
+
+func (r *ResourceRule) String() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	var conditions []string
+	list := func(key string, values []string) {
+		if len(values) > 0 {
+			conditions = append(conditions, key+"="+strings.Join(values, ","))
+		}
+	}
+	list("ids", r.Ids)
+	list("orgs", r.Organizations)
+	list("tags", r.Tags)
+	list("formats", r.Formats)
+	if r.MinSize > 0 || r.MaxSize > 0 {
+		conditions = append(conditions, fmt.Sprintf("size=%d-%d", r.MinSize, r.MaxSize))
+	}
+	if r.NamePattern != "" {
+		conditions = append(conditions, "name_pattern="+r.NamePattern)
+	}
+	list("frequencies", r.Frequencies)
+	return strings.Join(conditions, " ")
+}
+
+func (r *ResourceRule) matches(datapackage FileResultItem, resource Resource) bool {
+	if len(r.Ids) > 0 && !containsFold(r.Ids, resource.Id) {
+		return false
+	}
+	if len(r.Organizations) > 0 && !containsFold(r.Organizations, datapackage.Organization.Name) && !containsFold(r.Organizations, datapackage.Organization.Id) {
+		return false
+	}
+	if len(r.Tags) > 0 && !hasTag(datapackage, r.Tags) {
+		return false
+	}
+	if len(r.Formats) > 0 && !containsFold(r.Formats, resource.Format) {
+		return false
+	}
+	if r.MinSize > 0 || r.MaxSize > 0 {
+		if resource.Size <= 0 || resource.Size < r.MinSize || (r.MaxSize > 0 && resource.Size > r.MaxSize) {
+			return false
+		}
+	}
+	if r.namePattern != nil && !r.namePattern.MatchString(resource.Name) {
+		return false
+	}
+	if len(r.Frequencies) > 0 {
+		frequency := resource.Frequency
+		if frequency == "" {
+			frequency = datapackage.Frequency
+		}
+		if !containsFold(r.Frequencies, frequency) {
+			return false
+		}
+	}
+	return true
+}
+
+// whether the resource is followed, and the rule that decided it when it is not
+func (r ResourceRules) Match(datapackage FileResultItem, resource Resource) (bool, string) {
+	for i := range r.Deny {
+		if r.Deny[i].matches(datapackage, resource) {
+			return false, "denied by rule " + r.Deny[i].String()
+		}
+	}
+	if len(r.Allow) == 0 {
+		return true, ""
+	}
+	for i := range r.Allow {
+		if r.Allow[i].matches(datapackage, resource) {
+			return true, ""
+		}
+	}
+	return false, "no allow rule matches"
+}
+
+// the configuration as it is in effect, safe to show
+func (c *Config) redacted() Config {
+	redacted := *c
+	if redacted.Telegram.Token != "" {
+		redacted.Telegram.Token = "<redacted>"
+	}
+	return redacted
+}
+
+// everything the worker logs goes to stderr through the redactor, stdout is left to what a command prints
+func setupLogging(config LogConfig) {
+	var level slog.Level
+	level.UnmarshalText([]byte(config.Level))
+	options := &slog.HandlerOptions{Level: level}
+	out := redactingWriter{w: os.Stderr}
+	var handler slog.Handler = slog.NewJSONHandler(out, options)
+	if config.Format == "text" {
+		handler = slog.NewTextHandler(out, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// the exit code for an error a command ended with
+func exitWith(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	slog.Error("Failed", "err", err)
+	var lockedErr *LockedError
+	switch {
+	case errors.As(err, &lockedErr):
+		return exitLocked
+	case errors.Is(err, ErrInterrupted):
+		return exitInterrupted
+	case errors.Is(err, ErrIncomplete):
+		return exitIncomplete
+	}
+	return exitFailed
+}
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(config *Config, fs *flag.FlagSet, args []string) int
+}
+
+var commands = []command{
+	{"run", "", "Publish whatever changed since the last run, bootstraps first when there is no last run", cmdRun},
+	{"bootstrap", "", "Download what changed recently without publishing it, the baseline later runs compare against", cmdBootstrap},
+	{"status", "", "Show what the worker is doing, who holds the lock and how the last run went", cmdStatus},
+	{"diff", "<resource id>", "Show the lines that changed between two stored versions of a resource, the last two by default", cmdDiff},
+	{"fetch", "<resource id>", "Download the current version of a single resource without publishing it", cmdFetch},
+	{"replay", "[event id...]", "Render changes from data/events/ again with the current templates and send them, to backfill a channel or after fixing a message", cmdReplay},
+	{"verify", "", "Check every stored version against its hash and the csv files and state against the histories", cmdVerify},
+	{"gc", "", "Apply the retention policy and the quota to the data directory", cmdGC},
+	{"export", "<resource id>", "Write out a stored version of a resource, the latest one by default", cmdExport},
+	{"config", "check", "Validate the configuration and print it as it is in effect, with the secrets redacted", cmdConfig},
+}
+
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: ./main <command> [flags] [args]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Without a command ./main runs. ./main help <command> lists the flags of a command.")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Exit codes:")
+	fmt.Fprintln(out, "  0   done")
+	fmt.Fprintln(out, "  1   failed")
+	fmt.Fprintln(out, "  2   bad usage or configuration")
+	fmt.Fprintln(out, "  3   done, but some resources failed or verify found problems")
+	fmt.Fprintln(out, "  4   interrupted")
+	fmt.Fprintln(out, "  75  another run holds the lock")
+}
+
+func newFlagSet(cmd command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: ./main %s\n\n%s\n\n", strings.TrimSpace(cmd.name+" [flags] "+cmd.args), cmd.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// flags may come before and after the arguments, the command expects exactly nargs of them or any number when nargs is negative
+func parseArgs(fs *flag.FlagSet, args []string, nargs int) ([]string, error) {
+	var positional []string
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if nargs >= 0 && len(positional) != nargs {
+		err := fmt.Errorf("expected %d arguments, got %d", nargs, len(positional))
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return nil, err
+	}
+	return positional, nil
+}
+
+// -h is not a mistake
+func usageExitCode(err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	return exitUsage
+}
+
+type pipelineFlags struct {
+	workers        *int
+	maxConnections *int
+	hostRate       *float64
+	maxBandwidth   *int64
+	retryAttempts  *int
+	retryDelay     *time.Duration
+	retryMaxDelay  *time.Duration
+}
+
+func addPipelineFlags(fs *flag.FlagSet) *pipelineFlags {
+	return &pipelineFlags{
+		workers:        fs.Int("workers", 8, "Number of resources downloaded in parallel"),
+		maxConnections: fs.Int("max-connections", 50, "Maximum number of requests in flight over all hosts"),
+		hostRate:       fs.Float64("host-rate", 2, "Maximum requests per second to a single host, 0 for no limit"),
+		maxBandwidth:   fs.Int64("max-bandwidth", 0, "Maximum download rate in bytes per second over all downloads, 0 for no limit"),
+		retryAttempts:  fs.Int("retry-attempts", 5, "How many times a single download or message is attempted within a run"),
+		retryDelay:     fs.Duration("retry-delay", 5*time.Second, "Backoff before the first retry, doubled on every further retry"),
+		retryMaxDelay:  fs.Duration("retry-max-delay", 2*time.Minute, "Longest backoff between two retries"),
+	}
+}
+
+type storeFlags struct {
+	fs        *flag.FlagSet
+	keepCsv   *bool
+	delta     *bool
+	storage   *string
+	gitRemote *string
+}
+
+func addStoreFlags(fs *flag.FlagSet) *storeFlags {
+	return &storeFlags{
+		fs:        fs,
+		keepCsv:   fs.Bool("keep-csv", false, "Keep an uncompressed copy of the latest version of every resource next to its history, on by default with -storage git"),
+		delta:     fs.Bool("delta", false, "Store new versions as the difference to the previous one"),
+		storage:   fs.String("storage", "files", "How the data tree is kept, files or git to commit it to a git repository in data/ after every run"),
+		gitRemote: fs.String("git-remote", "", "With -storage git, push the archive to this remote after every commit"),
+	}
+}
+
+type bootstrapFilterFlags struct {
+	window               *time.Duration
+	organizations        *string
+	excludeOrganizations *string
+	tags                 *string
+	excludeTags          *string
+	formats              *string
+	maxSize              *int
+	resources            *string
+}
+
+// bootstrap takes them as they are, run with a bootstrap- prefix for when it has to bootstrap first
+func addBootstrapFilterFlags(fs *flag.FlagSet, prefix string) *bootstrapFilterFlags {
+	return &bootstrapFilterFlags{
+		window:               fs.Duration(prefix+"window", 7*24*time.Hour, "Bootstrap the resources modified within this long"),
+		organizations:        fs.String(prefix+"orgs", "", "Comma separated organization names bootstrap is limited to"),
+		excludeOrganizations: fs.String(prefix+"exclude-orgs", "", "Comma separated organization names bootstrap leaves out"),
+		tags:                 fs.String(prefix+"tags", "", "Comma separated tags, bootstrap is limited to datasets with one of them"),
+		excludeTags:          fs.String(prefix+"exclude-tags", "", "Comma separated tags, bootstrap leaves out datasets with one of them"),
+		formats:              fs.String(prefix+"formats", "CSV", "Comma separated resource formats bootstrap downloads"),
+		maxSize:              fs.Int(prefix+"max-size", 0, "Largest resource in bytes bootstrap downloads, 0 for no limit"),
+		resources:            fs.String(prefix+"resources", "", "Comma separated resource ids, bootstrap downloads only these whatever their age"),
+	}
+}
+
+func (f *bootstrapFilterFlags) filter() BootstrapFilter {
+	return BootstrapFilter{
+		Window:               *f.window,
+		Organizations:        splitList(*f.organizations),
+		ExcludeOrganizations: splitList(*f.excludeOrganizations),
+		Tags:                 splitList(*f.tags),
+		ExcludeTags:          splitList(*f.excludeTags),
+		Formats:              splitList(*f.formats),
+		MaxSize:              *f.maxSize,
+		Resources:            splitList(*f.resources),
+	}
+}
+
+// every problem at once, a zero or negative delay would otherwise make the backoff panic halfway through a run
+func (f *pipelineFlags) validate() error {
+	var errs []error
+	if *f.retryAttempts < 1 {
+		errs = append(errs, fmt.Errorf("-retry-attempts %d has to be at least 1", *f.retryAttempts))
+	}
+	if *f.retryDelay <= 0 {
+		errs = append(errs, fmt.Errorf("-retry-delay %s has to be positive", *f.retryDelay))
+	}
+	if *f.retryMaxDelay <= 0 {
+		errs = append(errs, fmt.Errorf("-retry-max-delay %s has to be positive", *f.retryMaxDelay))
+	}
+	return errors.Join(errs...)
+}
+
+func newRunner(config *Config, pipeline *pipelineFlags, store *storeFlags) (*Runner, error) {
+	err := pipeline.validate()
+	if err != nil {
+		return nil, err
+	}
+	storage, err := NewStorageBackend(*store.storage, "data", *store.gitRemote)
+	if err != nil {
+		return nil, err
+	}
+	keepCsvSet := false
+	store.fs.Visit(func(f *flag.Flag) {
+		keepCsvSet = keepCsvSet || f.Name == "keep-csv"
+	})
+	// the csvs are what the git history is made of
+	if *store.storage == "git" && !keepCsvSet {
+		*store.keepCsv = true
+	}
+	if *store.storage == "git" && !*store.keepCsv {
+		slog.Warn("Without -keep-csv the git archive only holds the version histories")
+	}
+	return &Runner{
+		config:     config,
+		downloader: NewDownloader(config.Download, *pipeline.workers, *pipeline.maxConnections, *pipeline.hostRate, *pipeline.maxBandwidth),
+		retryPolicy: RetryPolicy{
+			MaxAttempts: *pipeline.retryAttempts,
+			BaseDelay:   *pipeline.retryDelay,
+			MaxDelay:    *pipeline.retryMaxDelay,
+		},
+		snapshots: NewSnapshotStore("data/objects", *store.delta),
+		storage:   storage,
+		keepCsv:   *store.keepCsv,
+	}, nil
+}
+
+// a single run under the lock, with its progress in data/status.json
+func runLocked(mode string, fn func() error) error {
+	runId, end := startRun(mode)
+	defer end()
+	return withRunLock(mode, func() error {
+		status := &WorkerStatus{
+			State:        "running",
+			Mode:         mode,
+			Pid:          os.Getpid(),
+			RunId:        runId,
+			RunStartedAt: time.Now().UTC(),
+		}
+		writeWorkerStatus(status)
+		err := fn()
+		status.RunFinishedAt = time.Now().UTC()
+		status.State = "finished"
+		if err != nil {
+			status.State = "failed"
+			status.LastError = err.Error()
+		}
+		writeWorkerStatus(status)
+		return err
+	})
+}
+
+func cmdRun(config *Config, fs *flag.FlagSet, args []string) int {
+	pipeline := addPipelineFlags(fs)
+	store := addStoreFlags(fs)
+	bootstrapFilter := addBootstrapFilterFlags(fs, "bootstrap-")
+	maxAttempts := fs.Int("max-attempts", 5, "How many runs in a row may fail on the same version of a resource before it is left alone")
+	notifyInterval := fs.Duration("notify-interval", 2*time.Second, "Minimum time between two telegram messages")
+	daemon := fs.Bool("daemon", false, "Keep running and update on a schedule instead of once")
+	interval := fs.Duration("interval", 8*time.Hour, "With -daemon, time from the start of one run to the start of the next")
+	scheduleExpr := fs.String("schedule", "", "With -daemon, a cron expression like \"0 6,14,22 * * *\" to run on instead of -interval")
+	dryRun := fs.Bool("dry-run", false, "Fetch and diff as usual but only print the messages as json lines, nothing is stored or sent")
+	dryRunOutput := fs.String("dry-run-output", "", "With -dry-run, write the messages to this file instead of stdout")
+	_, err := parseArgs(fs, args, 0)
+	if err != nil {
+		return usageExitCode(err)
+	}
+	if *dryRun && *daemon {
+		fmt.Fprintln(fs.Output(), "-dry-run and -daemon do not go together")
+		return exitUsage
+	}
+
+	var schedule Schedule = IntervalSchedule(*interval)
+	scheduleName := "every " + interval.String()
+	// with an interval the first run starts right away, with a cron expression it waits for its turn
+	next := time.Now()
+	if *daemon && *scheduleExpr != "" {
+		cronSchedule, err := ParseCronSchedule(*scheduleExpr)
+		if err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return exitUsage
+		}
+		schedule = cronSchedule
+		scheduleName = *scheduleExpr
+		next = schedule.Next(time.Now())
+		if next.IsZero() {
+			fmt.Fprintln(fs.Output(), "Cron expression", *scheduleExpr, "never matches")
+			return exitUsage
+		}
+	} else if *daemon && *interval <= 0 {
+		fmt.Fprintln(fs.Output(), "-interval has to be positive")
+		return exitUsage
 	}
 
-	datasetName := resource.Name
-	var datasetDiff string
-
-	if isRegularDiff {
-		diffSlice, remainingCount := findSubSliceOfMaxLen(diff, 3800, len(utf16.Encode([]rune(datasetName))))
-		datasetDiffJoined := strings.Join(diffSlice, "\n")
+	runner, err := newRunner(config, pipeline, store)
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return exitUsage
+	}
+	runner.maxAttempts = *maxAttempts
+	runner.notifyInterval = *notifyInterval
+	runner.bootstrapFilter = bootstrapFilter.filter()
+	stop, ctx := signalContexts()
 
-		if remainingCount == 0 {
-			datasetDiff = datasetDiffJoined
-		} else {
-			datasetDiff = fmt.Sprintf("%s\n... and %d more", datasetDiffJoined, remainingCount)
+	if *dryRun {
+		out := io.Writer(os.Stdout)
+		if *dryRunOutput != "" {
+			file, err := os.Create(*dryRunOutput)
+			if err != nil {
+				return exitWith(err)
+			}
+			defer file.Close()
+			out = file
 		}
+		_, end := startRun("dry-run")
+		defer end()
+		return exitWith(runner.DryRun(ctx, stop, out))
 	}
 
-	if isFlightData {
-		departed := make(map[string]int)
-		landed := make(map[string]int)
-		cancelled := make(map[string]int)
+	if *daemon {
+		err = os.MkdirAll("data", 0755)
+		if err != nil {
+			return exitWith(err)
+		}
+		runDaemon(ctx, stop, runner, schedule, scheduleName, next)
+		slog.Info("Stopped")
+		return exitOK
+	}
+	err = runLocked("run", func() error {
+		err := runner.Update(ctx, stop)
+		if err == nil {
+			slog.Info("Done")
+		}
+		return err
+	})
+	return exitWith(err)
+}
 
-		for _, flightEntry := range diff {
-			splitFlightEntry := strings.Split(flightEntry, ",")
+func cmdBootstrap(config *Config, fs *flag.FlagSet, args []string) int {
+	pipeline := addPipelineFlags(fs)
+	store := addStoreFlags(fs)
+	bootstrapFilter := addBootstrapFilterFlags(fs, "")
+	plan := fs.Bool("plan", false, "Only print how many resources and bytes the bootstrap would download")
+	_, err := parseArgs(fs, args, 0)
+	if err != nil {
+		return usageExitCode(err)
+	}
 
-			countryName := splitFlightEntry[11]
-			statusString := splitFlightEntry[15]
+	runner, err := newRunner(config, pipeline, store)
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return exitUsage
+	}
+	runner.bootstrapFilter = bootstrapFilter.filter()
+	if *plan {
+		return exitWith(runner.Plan())
+	}
 
-			switch statusString {
-			case "LANDED":
-				landed[countryName] += 1
-			case "DEPARTED":
-				departed[countryName] += 1
-			case "CANCELED":
-				cancelled[countryName] += 1
-			}
+	stop, ctx := signalContexts()
+	err = runLocked("bootstrap", func() error {
+		err := runner.Bootstrap(ctx, stop)
+		if err == nil {
+			slog.Info("Done")
 		}
+		return err
+	})
+	return exitWith(err)
+}
 
-		var stringArrayToBuildMessage []string
+// who holds the run lock, nil when nobody does
+func readRunLock(path string) (*RunLockInfo, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	// a shared lock is only refused while a run holds the exclusive one
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		return nil, nil
+	} else if !errors.Is(err, syscall.EWOULDBLOCK) {
+		return nil, err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	holder, err := parseRunLockInfo(data)
+	if err != nil {
+		return nil, err
+	}
+	return &holder, nil
+}
 
-		stringArrayToBuildMessage = append(stringArrayToBuildMessage, "🛫 Departures To:")
+// read a json file into v, leaves v alone when the file is not there
+func readOptionalJson(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
 
-		for key, value := range departed {
-			stringArrayToBuildMessage = append(stringArrayToBuildMessage, fmt.Sprintf("%s: %d", key, value))
-		}
+type StatusSummary struct {
+	Worker  *WorkerStatus `json:"worker"`
+	Lock    *RunLockInfo  `json:"lock"`
+	LastRun *RunReport    `json:"last_run"`
+	// resources in the state, waiting for their message and waiting for a retry
+	Tracked  int `json:"tracked"`
+	Pending  int `json:"pending"`
+	Retrying int `json:"retrying"`
+}
 
-		stringArrayToBuildMessage = append(stringArrayToBuildMessage, "🛬 Arrived From:")
+func cmdStatus(config *Config, fs *flag.FlagSet, args []string) int {
+	asJson := fs.Bool("json", false, "Print the status as json")
+	_, err := parseArgs(fs, args, 0)
+	if err != nil {
+		return usageExitCode(err)
+	}
 
-		for key, value := range landed {
-			stringArrayToBuildMessage = append(stringArrayToBuildMessage, fmt.Sprintf("%s: %d", key, value))
+	var summary StatusSummary
+	err = readOptionalJson("data/status.json", &summary.Worker)
+	if err != nil {
+		return exitWith(err)
+	}
+	err = readOptionalJson("data/last_run.json", &summary.LastRun)
+	if err != nil {
+		return exitWith(err)
+	}
+	summary.Lock, err = readRunLock("data/run.lock")
+	if err != nil {
+		return exitWith(err)
+	}
+	state, err := peekState("data/state.json")
+	if err != nil {
+		return exitWith(err)
+	}
+	for _, resourceState := range state.All() {
+		summary.Tracked++
+		if resourceState.Outbox != nil {
+			summary.Pending++
 		}
-
-		stringArrayToBuildMessage = append(stringArrayToBuildMessage, "❌ Cancelled Flights:")
-
-		for key, value := range cancelled {
-			stringArrayToBuildMessage = append(stringArrayToBuildMessage, fmt.Sprintf("%s: %d", key, value))
+		if resourceState.Retry != nil {
+			summary.Retrying++
 		}
+	}
 
-		datasetDiff = strings.Join(stringArrayToBuildMessage, "\n")
+	if *asJson {
+		data, err := json.MarshalIndent(&summary, "", "  ")
+		if err != nil {
+			return exitWith(err)
+		}
+		fmt.Println(string(data))
+		return exitOK
+	}
+	if worker := summary.Worker; worker != nil {
+		fmt.Println("Worker:", worker.State, worker.Mode, "updated", worker.UpdatedAt.Local().Format(time.RFC3339))
+		if worker.Schedule != "" {
+			fmt.Println("Schedule:", worker.Schedule)
+		}
+		if worker.NextRunAt != nil {
+			fmt.Println("Next run:", worker.NextRunAt.Local().Format(time.RFC3339))
+		}
+		if worker.LastError != "" {
+			fmt.Println("Last error:", worker.LastError)
+		}
+	} else {
+		fmt.Println("Worker: no status yet")
+	}
+	if lock := summary.Lock; lock != nil {
+		fmt.Println("Lock: held by", lock.Mode, "pid", lock.Pid, "on", lock.Host, "since", lock.StartedAt.Local().Format(time.RFC3339), "last heartbeat", time.Since(lock.Heartbeat).Round(time.Second), "ago")
+	} else {
+		fmt.Println("Lock: free")
+	}
+	if lastRun := summary.LastRun; lastRun != nil {
+		fmt.Println("Last run:", lastRun.Mode, "finished", lastRun.FinishedAt.Local().Format(time.RFC3339)+",", lastRun.Updated, "of", lastRun.Checked, "updated,", lastRun.Failed, "failed")
+		if lastRun.Interrupted {
+			fmt.Println("  interrupted")
+		}
+		for category, count := range lastRun.FailuresByCategory {
+			fmt.Printf("  %s\t%d\n", category, count)
+		}
+	} else {
+		fmt.Println("Last run: none yet")
 	}
+	fmt.Println("Resources:", summary.Tracked, "tracked,", summary.Pending, "messages pending,", summary.Retrying, "waiting for a retry")
+	return exitOK
+}
 
-	prefixLen := len(utf16.Encode([]rune(prefix)))
-	datasetNameLen := len(utf16.Encode([]rune(datasetName)))
-	datasetDiffLen := len(utf16.Encode([]rune(datasetDiff)))
+func cmdDiff(config *Config, fs *flag.FlagSet, args []string) int {
+	from := fs.String("from", "", "The version we had at this time (RFC 3339 or 2006-01-02), the one before -to by default")
+	to := fs.String("to", "", "The version we had at this time (RFC 3339 or 2006-01-02), the latest by default")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return usageExitCode(err)
+	}
+	resourceId := positional[0]
 
-	var tagNames []string
-	//var tagOffsets []int
-	//var tagLengths []int
+	state, err := peekState("data/state.json")
+	if err != nil {
+		return exitWith(err)
+	}
+	csvPath, err := findResourceCsv(state, resourceId)
+	if err != nil {
+		return exitWith(err)
+	}
+	versions, err := loadVersions(csvPath)
+	if err != nil {
+		return exitWith(err)
+	}
+	toIndex, err := selectVersion(versions, *to)
+	if err != nil {
+		return exitWith(fmt.Errorf("%s: %v", resourceId, err))
+	}
+	fromIndex := toIndex - 1
+	if *from != "" {
+		fromIndex, err = selectVersion(versions, *from)
+		if err != nil {
+			return exitWith(fmt.Errorf("%s: %v", resourceId, err))
+		}
+	}
 
-	// parse datapackage tags
-	for _, tag := range datapackage.Tags {
-		tagName := strings.ReplaceAll(tag.DisplayName, " ", "_")
-		tagNames = append(tagNames, fmt.Sprintf("#%s", tagName))
+	snapshots := NewSnapshotStore("data/objects", false)
+	var oldfile []byte
+	if fromIndex >= 0 {
+		oldfile, err = snapshots.Read(versions[fromIndex].SHA256)
+		if err != nil {
+			return exitWith(err)
+		}
+		fmt.Println("---", versions[fromIndex].FetchedAt.Format(time.RFC3339), versions[fromIndex].SHA256)
+	} else {
+		fmt.Println("--- nothing")
+	}
+	newfile, err := snapshots.Read(versions[toIndex].SHA256)
+	if err != nil {
+		return exitWith(err)
+	}
+	fmt.Println("+++", versions[toIndex].FetchedAt.Format(time.RFC3339), versions[toIndex].SHA256)
+	for _, line := range diffLines(newfile, oldfile) {
+		fmt.Println("-" + line)
 	}
+	for _, line := range diffLines(oldfile, newfile) {
+		fmt.Println("+" + line)
+	}
+	return exitOK
+}
 
-	tagString := strings.Join(tagNames, " ")
+func cmdFetch(config *Config, fs *flag.FlagSet, args []string) int {
+	pipeline := addPipelineFlags(fs)
+	store := addStoreFlags(fs)
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return usageExitCode(err)
+	}
+	resourceId := positional[0]
 
-	blockquoteMsgEntity := MessageEntity{
-		Type:   "expandable_blockquote",
-		Offset: prefixLen + datasetNameLen + 2,
-		Length: datasetDiffLen,
+	runner, err := newRunner(config, pipeline, store)
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return exitUsage
 	}
+	_, ctx := signalContexts()
+	err = runLocked("fetch", func() error {
+		_, datafile, err := fetchPackageData()
+		if err != nil {
+			return err
+		}
+		for _, datapackage := range datafile.Result.Results {
+			for _, resource := range datapackage.Resources {
+				if resource.Id != resourceId {
+					continue
+				}
+				state, err := loadState("data/state.json")
+				if err != nil {
+					return err
+				}
+				defer state.Close()
+				metrics := openMetrics(runner.downloader, 30*time.Second)
+				defer metrics.Close()
+				metrics.addChecked()
+				worker := &Worker{
+					config:      config,
+					downloader:  runner.downloader,
+					retryPolicy: runner.retryPolicy,
+					state:       state,
+					snapshots:   runner.snapshots,
+					keepCsv:     runner.keepCsv,
+					report:      &RunReport{Mode: "fetch", FailuresByCategory: make(map[string]int)},
+					metrics:     metrics,
+				}
+				resourceLogger(datapackage, resource).Info("Fetching", "name", resource.Name, "title", datapackage.Title)
+				err = worker.fetchResource(ctx, datapackage, resource)
+				if err != nil {
+					metrics.addFailed(failureCategory(err))
+					return err
+				}
+				err = runner.storage.Commit("fetch", datasetTitles(File{Result: FileResult{Results: []FileResultItem{datapackage}}}))
+				if err != nil {
+					slog.Error("Failed to archive the data tree", "err", err)
+				}
+				return state.Compact()
+			}
+		}
+		return fmt.Errorf("resource %s is not in the catalogue", resourceId)
+	})
+	return exitWith(err)
+}
 
-	urllinkMsgEntity := MessageEntity{
-		Type:   "text_link",
-		Url:    fmt.Sprintf("https://data.gov.il/dataset/%s/resource/%s", datapackage.Id, resource.Id),
-		Offset: prefixLen + 1,
-		Length: datasetNameLen,
+// a time, or a duration back from now like 168h or 7d
+func parseSinceArg(value string) (time.Time, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err == nil {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
 	}
-	// send message
-	payload := SendMessagePayload{
-		ChatId: "@datasoup",
-		Text:   strings.Join([]string{prefix, datasetName, datasetDiff, tagString}, "\n"),
-		Entities: []MessageEntity{
-			blockquoteMsgEntity,
-			urllinkMsgEntity,
-		},
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
 	}
-	return payload
+	return parseTimeArg(value)
 }
 
-func main() {
-	bootstrapPtr := flag.Bool("bootstrap", false, "Bootstrap the data files")
-	flag.Parse()
-	fmt.Println("Hello, World!")
-	if *bootstrapPtr {
-		fmt.Println("Bootstrapping data files")
-		// Ensure data dir exists
-		err := os.MkdirAll("data", 0666)
+func cmdReplay(config *Config, fs *flag.FlagSet, args []string) int {
+	since := fs.String("since", "", "Replay every event from this time on (RFC 3339 or 2006-01-02) or this far back (168h or 7d)")
+	chat := fs.String("chat", "", "Send to this chat instead of telegram.chat_id, a @channel or a numeric chat id")
+	stored := fs.Bool("stored", false, "Send the messages as they were sent the first time instead of rendering them again")
+	dryRun := fs.Bool("dry-run", false, "Print the messages as json lines instead of sending them")
+	notifyInterval := fs.Duration("notify-interval", 2*time.Second, "Minimum time between two telegram messages")
+	ids, err := parseArgs(fs, args, -1)
+	if err != nil {
+		return usageExitCode(err)
+	}
+	if *chat != "" && !validChatId(*chat) {
+		fmt.Fprintf(fs.Output(), "-chat %q is neither a @channel nor a numeric chat id\n", *chat)
+		return exitUsage
+	}
+	if *since != "" {
+		sinceTime, err := parseSinceArg(*since)
 		if err != nil {
-			log.Fatalln(err)
+			fmt.Fprintln(fs.Output(), "-since:", err)
+			return exitUsage
 		}
-		// Get json from datagov
-		resp, err := http.Post("https://data.gov.il/api/3/action/package_search", "application/json", strings.NewReader(`{"rows": 99999}`))
+		sinceIds, err := listChangeEvents(sinceTime)
 		if err != nil {
-			log.Fatalln(err)
+			return exitWith(err)
 		}
-		// write json response to file
-		file, err := os.Create("data/packagedata.json")
-		if err != nil {
-			log.Fatalln(err)
+		ids = append(ids, sinceIds...)
+	}
+	// an event named on the command line and found again by -since is still sent once, where it first came up
+	seen := make(map[string]bool)
+	unique := ids[:0]
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	ids = unique
+	if len(ids) == 0 {
+		if *since != "" {
+			slog.Info("No events to replay", "since", *since)
+			return exitOK
 		}
+		fmt.Fprintln(fs.Output(), "expected event ids or -since")
+		fs.Usage()
+		return exitUsage
+	}
 
-		_, err = io.Copy(file, resp.Body)
+	var telegram *TelegramClient
+	if !*dryRun {
+		telegram, err = NewTelegramClient(config)
 		if err != nil {
-			log.Fatalln(err)
+			return exitWith(err)
 		}
-		file.Close()
-		resp.Body.Close()
-
-		// unmarsal json to struct
-		data, err := os.ReadFile("data/packagedata.json")
+	}
+	_, end := startRun("replay")
+	defer end()
+	stop, _ := signalContexts()
+	snapshots := NewSnapshotStore("data/objects", false)
+	retryPolicy := RetryPolicy{MaxAttempts: 5, BaseDelay: 5 * time.Second, MaxDelay: 2 * time.Minute}
+	encoder := json.NewEncoder(os.Stdout)
+	sent, failed := 0, 0
+	for _, id := range ids {
+		event, err := loadChangeEvent(id)
 		if err != nil {
-			log.Fatalln(err)
+			slog.Error("Failed to load event", "event", id, "err", err)
+			failed++
+			continue
 		}
-		var datafile File
-		json.Unmarshal(data, &datafile)
-
-		client := &http.Client{Transport: &http.Transport{MaxConnsPerHost: 50}}
-
-		var waitGroup sync.WaitGroup
-		var packageCount int
-		for _, datapackage := range datafile.Result.Results {
-			for _, resource := range datapackage.Resources {
-				if resource.Format == "CSV" {
-					metadataTime, err := time.Parse("2006-01-02T15:04:05.000000", resource.MetadataModified)
-					if err != nil {
-						log.Fatalln(err)
-					}
-					if metadataTime.After(time.Now().AddDate(0, 0, -7)) { // if modified in the last 6 months
-						waitGroup.Add(1)
-						packageCount++
-						go fetchResource(resource, datapackage, &waitGroup, client, 5)
-					}
-				}
+		logger := resourceLogger(event.Package, event.Resource).With("event", id)
+		payload := event.Payload
+		if !*stored {
+			// the versions may have been pruned by gc since
+			payload, err = snapshots.rerender(config.Telegram, event)
+			if err != nil {
+				logger.Error("Failed to render event again", "err", err)
+				failed++
+				continue
 			}
 		}
-		fmt.Println("Waiting for downloads to finish...")
-		fmt.Println("Downloading", packageCount, "resources")
-		waitGroup.Wait()
-		fmt.Println("Downloads finished!")
-
-	} else {
-		fmt.Println("Running normally")
-		// telegram bot
-		// load token from environment variable
-		token := os.Getenv("TELEGRAM_TOKEN")
-		if token == "" {
-			// fallback to reading from file for backward compatibility
-			tokenBytes, err := os.ReadFile(".telegram_token")
+		if *chat != "" {
+			payload.ChatId = *chat
+		}
+		if *dryRun {
+			event.Payload = payload
+			err = encoder.Encode(event)
 			if err != nil {
-				log.Fatalln("TELEGRAM_TOKEN environment variable not set and .telegram_token file not found")
+				return exitWith(err)
 			}
-			token = string(tokenBytes)
+			continue
 		}
-		endpointUrl := fmt.Sprint("https://api.telegram.org/bot", token)
 
-		// check that it works
-		respBotCheck, err := http.Get(fmt.Sprint(endpointUrl, "/getMe"))
-		if err != nil {
-			log.Fatalln(err)
+		if sent > 0 {
+			select {
+			case <-time.After(*notifyInterval):
+			case <-stop.Done():
+			}
+		}
+		if stop.Err() != nil {
+			slog.Warn("Stopped", "sent", sent, "events", len(ids))
+			return exitWith(ErrInterrupted)
 		}
-		// print body
-		bodyBotCheck, err := io.ReadAll(respBotCheck.Body)
+		err = retryPolicy.Do(stop, logger, func(ctx context.Context) error {
+			return telegram.SendMessage(payload)
+		})
 		if err != nil {
-			log.Fatalln(err)
+			logger.Error("Failed to send event", "err", err)
+			failed++
+			continue
 		}
-		fmt.Println(string(bodyBotCheck))
-		respBotCheck.Body.Close()
+		sent++
+		logger.Info("Sent event", "chat_id", payload.ChatId)
+	}
+	if failed > 0 {
+		return exitWith(fmt.Errorf("%w: %d of %d events failed", ErrIncomplete, failed, len(ids)))
+	}
+	return exitOK
+}
 
-		// Parse previous file for last modified date
-		data, err := os.ReadFile("data/packagedata.json")
+// everything in the data directory agrees with itself, the problems are returned rather than stopping at the first
+func verifyStore(state *StateStore, snapshots *SnapshotStore) (int, []string, error) {
+	var problems []string
+	checked := 0
+	latest := make(map[string]string)
+	histories, err := filepath.Glob(filepath.Join("data", "*", "*", "*.versions.json"))
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, history := range histories {
+		csvPath := strings.TrimSuffix(history, ".versions.json") + ".csv"
+		versions, err := loadVersions(csvPath)
 		if err != nil {
-			log.Fatalln(err)
+			problems = append(problems, fmt.Sprintf("%s: %v", history, err))
+			continue
+		}
+		for _, version := range versions {
+			checked++
+			_, err := snapshots.Read(version.SHA256)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: version %s: %v", history, version.FetchedAt.Format(time.RFC3339), err))
+			}
+		}
+		if len(versions) == 0 {
+			continue
+		}
+		latest[csvPath] = versions[len(versions)-1].SHA256
+
+		// the csv is a copy of the latest version, when it is kept at all
+		file, err := os.Open(csvPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", csvPath, err))
+			continue
 		}
-		var datafile File
-		json.Unmarshal(data, &datafile)
-		refTime, err := time.Parse("2006-01-02T15:04:05.000000", datafile.Result.Results[0].MetadataModified) // wtf golang time parsing ಠ_ಠ
+		hash := sha256.New()
+		_, err = io.Copy(hash, file)
+		file.Close()
 		if err != nil {
-			log.Fatalln(err)
+			problems = append(problems, fmt.Sprintf("%s: %v", csvPath, err))
+		} else if sum := hex.EncodeToString(hash.Sum(nil)); sum != latest[csvPath] {
+			problems = append(problems, fmt.Sprintf("%s: is %s, the latest version is %s", csvPath, sum, latest[csvPath]))
+		}
+	}
+
+	for resourceId, resourceState := range state.All() {
+		if resourceState.SHA256 == "" {
+			continue
+		}
+		csvPath := filepath.Join("data", resourceState.Organization, resourceState.PackageId, resourceId+".csv")
+		if hash, ok := latest[csvPath]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: in the state but has no history", resourceId))
+		} else if hash != resourceState.SHA256 {
+			problems = append(problems, fmt.Sprintf("%s: the state has %s, the latest version is %s", resourceId, resourceState.SHA256, hash))
 		}
-		fmt.Println(refTime)
+	}
+	return checked, problems, nil
+}
 
-		// Get json from datagov
-		resp, err := http.Post("https://data.gov.il/api/3/action/package_search", "application/json", strings.NewReader(`{"rows": 99999}`))
+func cmdVerify(config *Config, fs *flag.FlagSet, args []string) int {
+	_, err := parseArgs(fs, args, 0)
+	if err != nil {
+		return usageExitCode(err)
+	}
+
+	// a run in progress would look like a broken store half way through
+	var problems []string
+	err = withRunLock("verify", func() error {
+		state, err := loadState("data/state.json")
 		if err != nil {
-			log.Fatalln(err)
+			return err
 		}
-		// read response body into memory
-		newDatafileBody, err := io.ReadAll(resp.Body)
+		defer state.Close()
+		var checked int
+		checked, problems, err = verifyStore(state, NewSnapshotStore("data/objects", false))
 		if err != nil {
-			log.Fatalln(err)
+			return err
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
 		}
-		resp.Body.Close()
+		fmt.Println("Verified", checked, "versions,", len(problems), "problems")
+		return nil
+	})
+	if err == nil && len(problems) > 0 {
+		return exitIncomplete
+	}
+	return exitWith(err)
+}
+
+func cmdGC(config *Config, fs *flag.FlagSet, args []string) int {
+	dryRun := fs.Bool("dry-run", false, "Only report what would be deleted")
+	keepVersions := fs.Int("keep-versions", 0, "Keep this many versions of every resource, 0 for all of them")
+	keepDays := fs.Int("keep-days", 0, "Keep the versions fetched in this many days, 0 for all of them")
+	quota := fs.Int64("quota", 0, "Bytes the datasets, their history and the state may take before the least recently updated datasets are evicted, 0 for no limit")
+	quarantineDays := fs.Int("quarantine-days", 14, "Delete rejected downloads quarantined longer ago than this many days, 0 keeps them")
+	_, err := parseArgs(fs, args, 0)
+	if err != nil {
+		return usageExitCode(err)
+	}
 
-		var newDatafile File
-		json.Unmarshal(newDatafileBody, &newDatafile)
-		if newDatafile.Success == false {
-			log.Fatalln("Failed to fetch new datafile")
+	_, end := startRun("gc")
+	defer end()
+	err = withRunLock("gc", func() error {
+		state, err := loadState("data/state.json")
+		if err != nil {
+			return err
+		}
+		defer state.Close()
+		policy := RetentionPolicy{
+			KeepVersions:   *keepVersions,
+			KeepDays:       *keepDays,
+			Quota:          *quota,
+			QuarantineDays: *quarantineDays,
+		}
+		report, err := collectGarbage(state, NewSnapshotStore("data/objects", false), policy, *dryRun)
+		if report != nil {
+			writeErr := writeGCReport(report)
+			if writeErr != nil {
+				slog.Error("Failed to write gc report", "err", writeErr)
+			}
 		}
+		return err
+	})
+	return exitWith(err)
+}
 
-		client := &http.Client{Transport: &http.Transport{MaxConnsPerHost: 50}}
-		charDetector := chardet.NewTextDetector()
+func cmdExport(config *Config, fs *flag.FlagSet, args []string) int {
+	list := fs.Bool("list", false, "List the stored versions instead")
+	at := fs.String("at", "", "The version we had at this time (RFC 3339 or 2006-01-02)")
+	output := fs.String("o", "", "Write the version to this file instead of stdout")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return usageExitCode(err)
+	}
+	resourceId := positional[0]
 
-		for _, datapackage := range newDatafile.Result.Results {
-			for _, resource := range datapackage.Resources {
-				if resource.Format == "CSV" && !isResourceExempt(resource.Id) && resource.Size < 200_000_000 { // is it csv, not excempt and less than 200 megabytes
-					curTime, err := time.Parse("2006-01-02T15:04:05.000000", resource.MetadataModified)
-					if err != nil {
-						log.Fatalln(err)
-					}
-					dirpath := filepath.Join("data", datapackage.Organization.Name, datapackage.Id)
-					filepath := filepath.Join("data", datapackage.Organization.Name, datapackage.Id, resource.Id+".csv")
-					// check if the resource file was modified after refTime
-					isFileOlderThanLastUpdate := false
-					fileInfo, err := os.Stat(filepath)
-					if err != nil {
-						// if the file doesnt exist then we say that its older
-						isFileOlderThanLastUpdate = true
-					} else if fileInfo.ModTime().Before(refTime) {
-						isFileOlderThanLastUpdate = true
-					}
+	state, err := peekState("data/state.json")
+	if err != nil {
+		return exitWith(err)
+	}
+	if *list {
+		return exitWith(listVersions(state, resourceId))
+	}
+	csvPath, err := findResourceCsv(state, resourceId)
+	if err != nil {
+		return exitWith(err)
+	}
+	versions, err := loadVersions(csvPath)
+	if err != nil {
+		return exitWith(err)
+	}
+	index, err := selectVersion(versions, *at)
+	if err != nil {
+		return exitWith(fmt.Errorf("%s: %v", resourceId, err))
+	}
+	content, err := NewSnapshotStore("data/objects", false).Read(versions[index].SHA256)
+	if err != nil {
+		return exitWith(err)
+	}
+	if *output != "" {
+		return exitWith(writeFileAtomic(*output, content, 0644))
+	}
+	_, err = os.Stdout.Write(content)
+	return exitWith(err)
+}
 
-					if curTime.After(refTime) && isFileOlderThanLastUpdate {
-						time.Sleep(2 * time.Second) // rate limit so telegram doesnt get mad
-						fmt.Println(resource.Url)
-						// fetch updated
-						req, err := http.NewRequest("GET", resource.Url, nil)
-						if err != nil {
-							log.Fatalln(err)
-						}
-						req.Header.Set("User-Agent", "github.com/wissotsky#datagov-external-client")
-						resp, err := client.Do(req) // TODO: Sometimes it returns an html page with 'Internal Server Error' must handle that as it currently corrupts the stored file
-						if err != nil {
-							log.Fatalln(err)
-						}
-						newfilebody, err := io.ReadAll(resp.Body)
-						if err != nil {
-							log.Fatalln(err)
-						}
-						resp.Body.Close()
-
-						// detect encoding
-						result, err := charDetector.DetectBest(newfilebody)
-						if err != nil {
-							log.Fatalln(err)
-						}
-						fmt.Println(result.Charset)
-						// if charset is ISO-8859-8 or ISO-8859-8-I then convert from windows1255 to utf8
-						if result.Charset != "UTF-8" {
-							decoder := charmap.Windows1255.NewDecoder()
-							newfilebody, err = decoder.Bytes(newfilebody)
-							if err != nil {
-								log.Fatalln(err)
-							}
-						}
-
-						// check if file already exists
-						if _, err := os.Stat(filepath); err == nil { // TODO: Redundant double check of file stat
-							// file exists
-							fmt.Println("File exists, diffing and overwriting")
-							oldfile, err := os.ReadFile(filepath)
-							if err != nil {
-								log.Fatalln(err)
-							}
-							// run diffing TODO: Dont publish message if there is no difference in the resource
-							oldlines := strings.Split(string(oldfile), "\n")
-							newlines := strings.Split(string(newfilebody), "\n")
-							var diff []string
-
-							hashmap := make(map[string]struct{}, len(oldlines))
-							for _, line := range oldlines {
-								hashmap[line] = struct{}{}
-							}
-
-							for _, line := range newlines {
-								if _, ok := hashmap[line]; !ok {
-									diff = append(diff, line)
-								}
-							}
-
-							payload := processDiffToPayload(false, diff, datapackage, resource)
-
-							payloadJson, err := json.Marshal(payload)
-							if err != nil {
-								log.Fatalln(err)
-							}
-							fmt.Println(string(payloadJson))
-							// TODO: send messsage to telegram
-							resp, err = http.Post(fmt.Sprint(endpointUrl, "/sendMessage"), "application/json", bytes.NewBuffer(payloadJson))
-							if err != nil {
-								log.Fatalln(err)
-							}
-							fmt.Println(resp)
-							// print body
-							body, err := io.ReadAll(resp.Body)
-							if err != nil {
-								log.Fatalln(err)
-							}
-							fmt.Println(string(body))
-							resp.Body.Close()
-
-							// overwrite file
-
-							file, err := os.Create(filepath)
-							if err != nil {
-								log.Fatalln(err)
-							}
-							_, err = file.Write(newfilebody)
-							if err != nil {
-								log.Fatalln(err)
-							}
-							file.Close()
-
-						} else if os.IsNotExist(err) {
-							// file does not exist
-							fmt.Println("File does not exist, creating")
-							err := os.MkdirAll(dirpath, 0666)
-							if err != nil {
-								log.Fatalln(err)
-							}
-							file, err := os.Create(filepath)
-							if err != nil {
-								log.Fatalln(err)
-							}
-							_, err = file.Write(newfilebody)
-							if err != nil {
-								log.Fatalln(err)
-							}
-							file.Close()
-
-							diff := strings.Split(string(newfilebody), "\n")
-
-							payload := processDiffToPayload(true, diff, datapackage, resource)
-
-							payloadJson, err := json.Marshal(payload)
-							if err != nil {
-								log.Fatalln(err)
-							}
-							fmt.Println(string(payloadJson))
-							// TODO: send messsage to telegram
-							resp, err = http.Post(fmt.Sprint(endpointUrl, "/sendMessage"), "application/json", bytes.NewBuffer(payloadJson))
-							if err != nil {
-								log.Fatalln(err)
-							}
-							fmt.Println(resp)
-							// print body
-							body, err := io.ReadAll(resp.Body)
-							if err != nil {
-								log.Fatalln(err)
-							}
-							fmt.Println(string(body))
-							resp.Body.Close()
-
-						} else {
-							log.Fatalln(err)
-						}
-					}
-				}
-			}
+func cmdConfig(config *Config, fs *flag.FlagSet, args []string) int {
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return usageExitCode(err)
+	}
+	if positional[0] != "check" {
+		fmt.Fprintln(fs.Output(), "Unknown config command", positional[0])
+		fs.Usage()
+		return exitUsage
+	}
 
+	// loading it already validated it
+	if config.path != "" {
+		fmt.Println("# loaded from", config.path)
+	} else {
+		fmt.Println("# no", configPath(), "found, the defaults")
+	}
+	data, err := yaml.Marshal(config.redacted())
+	if err != nil {
+		return exitWith(err)
+	}
+	fmt.Print(string(data))
+	if config.Telegram.Token == "" {
+		fmt.Println("# no telegram token, run can not publish anything")
+	}
+	return exitOK
+}
+
+func main() {
+	// until the config says otherwise
+	setupLogging(defaultConfig().Log)
+	args := os.Args[1:]
+	// without a command it runs, like it always did
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	} else if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+		name = "help"
+	}
+	if name == "help" {
+		if len(args) == 0 {
+			printUsage()
+			os.Exit(exitOK)
+		}
+		// the flags of a command are its help
+		name, args = args[0], []string{"-h"}
+	}
+	for _, arg := range args {
+		if arg == "-bootstrap" || arg == "--bootstrap" {
+			fmt.Fprintln(os.Stderr, "-bootstrap is a command of its own now: ./main bootstrap")
+			os.Exit(exitUsage)
 		}
-		fmt.Println("Done updating, overwriting packagedata.json")
-		// overwrite packagedata.json
+	}
 
-		file, err := os.Create("data/packagedata.json")
-		if err != nil {
-			log.Fatalln(err)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
 		}
-		_, err = file.Write(newDatafileBody)
+		config, err := loadConfig(configPath())
 		if err != nil {
-			log.Fatalln(err)
+			fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+			os.Exit(exitUsage)
 		}
-		file.Close()
-
+		setupLogging(config.Log)
+		os.Exit(cmd.run(config, newFlagSet(cmd), args))
 	}
-
-	fmt.Println("Done!")
+	fmt.Fprintln(os.Stderr, "Unknown command", name)
+	printUsage()
+	os.Exit(exitUsage)
 
 	// may the operating system be our garbage collector and handle handler （￣︶￣）↗
 }
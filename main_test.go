@@ -0,0 +1,1112 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/saintfish/chardet"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// main.go and monitoring_server.go are separate programs, run these with go test main.go main_test.go
+
+func TestValidateDownload(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		// empty when the download is fine
+		reason string
+	}{
+		{name: "csv", status: 200, contentType: "text/csv", body: "id,name\n1,a\n"},
+		{name: "csv without a content type", status: 200, body: "id,name\n1,a\n"},
+		{name: "csv served as octet stream", status: 200, contentType: "application/octet-stream", body: "id,name\n1,a\n"},
+		{name: "csv with a byte order mark", status: 200, contentType: "text/csv", body: "\xEF\xBB\xBFid,name\n1,a\n"},
+		{name: "hebrew csv", status: 200, contentType: "text/csv; charset=windows-1255", body: "\xf9\xed,\xee\xf1\n1,2\n"},
+		{name: "partial content", status: 206, contentType: "text/csv", body: "1,a\n"},
+		{name: "server error", status: 500, contentType: "text/csv", body: "id,name\n", reason: "unexpected status 500 Internal Server Error"},
+		{name: "not found", status: 404, body: "id,name\n", reason: "unexpected status 404 Not Found"},
+		{name: "html content type", status: 200, contentType: "text/html; charset=utf-8", body: "id,name\n", reason: "unexpected content type text/html"},
+		{name: "json content type", status: 200, contentType: "application/json", body: "id,name\n", reason: "unexpected content type application/json"},
+		{name: "problem json", status: 200, contentType: "application/problem+json", body: "id,name\n", reason: "unexpected content type application/problem+json"},
+		{name: "empty body", status: 200, contentType: "text/csv", body: "", reason: "empty body"},
+		{name: "blank body", status: 200, contentType: "text/csv", body: " \r\n\t\n", reason: "blank body"},
+		{name: "byte order mark only", status: 200, contentType: "text/csv", body: "\xEF\xBB\xBF\n", reason: "blank body"},
+		{name: "html page served as csv", status: 200, contentType: "text/csv", body: "\n  <!DOCTYPE html><html><body>Internal Server Error</body></html>", reason: "body looks like html"},
+		{name: "html without a doctype", status: 200, contentType: "text/csv", body: "<html><head><title>Error</title></head></html>", reason: "body looks like html"},
+		{name: "xml", status: 200, contentType: "text/csv", body: "<?xml version=\"1.0\"?><error/>", reason: "body looks like html"},
+		{name: "json error served as csv", status: 200, contentType: "text/csv", body: "{\"success\": false}", reason: "body looks like json"},
+	}
+	for _, test := range tests {
+		resp := &http.Response{
+			StatusCode: test.status,
+			Status:     fmt.Sprintf("%d %s", test.status, http.StatusText(test.status)),
+			Header:     http.Header{},
+		}
+		if test.contentType != "" {
+			resp.Header.Set("Content-Type", test.contentType)
+		}
+		err := validateDownload(resp, []byte(test.body))
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		var invalid *InvalidDownloadError
+		if !errors.As(err, &invalid) {
+			t.Errorf("%s: got %v, want an invalid download", test.name, err)
+			continue
+		}
+		if invalid.Reason != test.reason {
+			t.Errorf("%s: reason %q, want %q", test.name, invalid.Reason, test.reason)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 5 * time.Second, MaxDelay: 2 * time.Minute}
+	tests := []struct {
+		policy  RetryPolicy
+		attempt int
+		// the delay before the random half is taken off
+		delay time.Duration
+	}{
+		{policy: policy, attempt: 1, delay: 5 * time.Second},
+		{policy: policy, attempt: 2, delay: 10 * time.Second},
+		{policy: policy, attempt: 3, delay: 20 * time.Second},
+		{policy: policy, attempt: 5, delay: 80 * time.Second},
+		{policy: policy, attempt: 6, delay: 2 * time.Minute},
+		{policy: policy, attempt: 30, delay: 2 * time.Minute},
+		{policy: policy, attempt: 31, delay: 2 * time.Minute},
+		{policy: RetryPolicy{BaseDelay: time.Minute, MaxDelay: time.Second}, attempt: 1, delay: time.Second},
+		{policy: policy, attempt: 64, delay: 2 * time.Minute},
+		{policy: policy, attempt: 1000, delay: 2 * time.Minute},
+		// shifting these up would overflow
+		{policy: RetryPolicy{BaseDelay: math.MaxInt64 / 3, MaxDelay: math.MaxInt64}, attempt: 2, delay: math.MaxInt64 / 3 * 2},
+		{policy: RetryPolicy{BaseDelay: math.MaxInt64 / 3, MaxDelay: math.MaxInt64}, attempt: 3, delay: math.MaxInt64},
+		{policy: RetryPolicy{BaseDelay: time.Hour, MaxDelay: math.MaxInt64}, attempt: 40, delay: math.MaxInt64},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			delay := test.policy.Backoff(test.attempt)
+			if delay < test.delay/2 || delay > test.delay {
+				t.Errorf("Backoff(%d) = %s, want between %s and %s", test.attempt, delay, test.delay/2, test.delay)
+				break
+			}
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{name: "error page served with a 200", err: &InvalidDownloadError{Reason: "body looks like html"}, retryable: true},
+		{name: "server error", err: &InvalidDownloadError{Reason: "unexpected status", StatusCode: 503}, retryable: true},
+		{name: "rate limited", err: &InvalidDownloadError{Reason: "unexpected status", StatusCode: 429}, retryable: true},
+		{name: "request timeout", err: &InvalidDownloadError{Reason: "unexpected status", StatusCode: 408}, retryable: true},
+		{name: "not found", err: &InvalidDownloadError{Reason: "unexpected status", StatusCode: 404}, retryable: false},
+		{name: "forbidden", err: &InvalidDownloadError{Reason: "unexpected status", StatusCode: 403}, retryable: false},
+		{name: "telegram server error", err: &HTTPStatusError{StatusCode: 502}, retryable: true},
+		{name: "telegram rate limit", err: &HTTPStatusError{StatusCode: 429}, retryable: true},
+		{name: "telegram bad request", err: &HTTPStatusError{StatusCode: 400}, retryable: false},
+		{name: "wrapped server error", err: fmt.Errorf("fetching: %w", &HTTPStatusError{StatusCode: 500}), retryable: true},
+		{name: "connection reset", err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}, retryable: true},
+		{name: "stalled server", err: fmt.Errorf("reading body: %w", &StalledError{After: time.Minute}), retryable: true},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, retryable: true},
+		{name: "broken pipe", err: syscall.EPIPE, retryable: true},
+		{name: "cut short", err: io.ErrUnexpectedEOF, retryable: true},
+		{name: "eof", err: fmt.Errorf("reading body: %w", io.EOF), retryable: true},
+		{name: "network timeout", err: &url.Error{Op: "Get", URL: "https://example.com", Err: timeoutError{}}, retryable: true},
+		{name: "canceled", err: context.Canceled, retryable: false},
+		{name: "deadline", err: fmt.Errorf("fetching: %w", context.DeadlineExceeded), retryable: false},
+		{name: "disk full", err: syscall.ENOSPC, retryable: false},
+		{name: "anything else", err: errors.New("bad csv"), retryable: false},
+	}
+	for _, test := range tests {
+		if retryable := isRetryable(test.err); retryable != test.retryable {
+			t.Errorf("%s: isRetryable(%v) = %v, want %v", test.name, test.err, retryable, test.retryable)
+		}
+	}
+}
+
+func TestDownloaderStalls(t *testing.T) {
+	tests := []struct {
+		name string
+		// what the server does before it hangs until the client gives up
+		handler func(w http.ResponseWriter)
+	}{
+		{name: "no headers", handler: func(w http.ResponseWriter) {}},
+		{name: "body stops", handler: func(w http.ResponseWriter) {
+			fmt.Fprint(w, "id,name\n1,a\n")
+			w.(http.Flusher).Flush()
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				test.handler(w)
+				<-r.Context().Done()
+			}))
+			defer server.Close()
+			config := defaultConfig().Download
+			config.ResponseHeaderTimeout = 50 * time.Millisecond
+			config.IdleTimeout = 50 * time.Millisecond
+			downloader := NewDownloader(config, 1, 1, 0, 0)
+			resp, err := downloader.Get(context.Background(), server.URL, nil)
+			if err == nil {
+				_, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			var stalled *StalledError
+			if !errors.As(err, &stalled) {
+				t.Fatalf("%v, want a stalled error", err)
+			}
+			if !isRetryable(err) {
+				t.Errorf("%v is not retryable", err)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 0},
+		{value: "0", want: 0},
+		{value: "30", want: 30 * time.Second},
+		{value: "-5", want: 0},
+		{value: "soon", want: 0},
+		{value: "Wed, 21 Oct 2015 07:28:00 GMT", want: 0},
+	}
+	for _, test := range tests {
+		if got := parseRetryAfter(test.value); got != test.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+	// a date in the future is how long until then
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(future); got < 58*time.Minute || got > time.Hour {
+		t.Errorf("parseRetryAfter(%q) = %s, want about an hour", future, got)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		value string
+		start int64
+		total int64
+		err   bool
+	}{
+		{value: "bytes 0-99/100", start: 0, total: 100},
+		{value: "bytes 500-999/1000", start: 500, total: 1000},
+		{value: "bytes 1024-2047/*", start: 1024, total: -1},
+		{value: "bytes 0-0/1", start: 0, total: 1},
+		{value: "bytes 9000000000-9000000001/9000000002", start: 9000000000, total: 9000000002},
+		{value: "", err: true},
+		{value: "bytes */100", err: true},
+		{value: "bytes 0-99", err: true},
+		{value: "bytes 0-99/abc", err: true},
+		{value: "items 0-99/100", err: true},
+	}
+	for _, test := range tests {
+		start, total, err := parseContentRange(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseContentRange(%q) = %d, %d, want an error", test.value, start, total)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseContentRange(%q): %v", test.value, err)
+			continue
+		}
+		if start != test.start || total != test.total {
+			t.Errorf("parseContentRange(%q) = %d, %d, want %d, %d", test.value, start, total, test.start, test.total)
+		}
+	}
+}
+
+func TestSnapshotStoreDelta(t *testing.T) {
+	base := "id,name,value\n" + strings.Repeat("1,row,10\n", 200)
+	tests := []struct {
+		name    string
+		base    string
+		content string
+		// how many deltas deep the stored version is, 0 when it is stored in full
+		depth int
+	}{
+		{name: "appended rows", base: base, content: base + "2,new,20\n3,new,30\n", depth: 1},
+		{name: "changed row", base: base, content: strings.Replace(base, "1,row,10", "1,row,11", 1), depth: 1},
+		{name: "removed rows", base: base, content: base[:len(base)-18], depth: 1},
+		{name: "prepended rows", base: base, content: "id,name,value\n0,first,0\n" + base[len("id,name,value\n"):], depth: 1},
+		{name: "emptied", base: base, content: "", depth: 1},
+		{name: "unchanged", base: base, content: base, depth: 0},
+		{name: "rewritten", base: base, content: strings.Repeat("9,other,99\n", 200), depth: 0},
+		{name: "from empty", base: "", content: base, depth: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewSnapshotStore(t.TempDir(), true)
+			baseVersion, err := store.Put(strings.NewReader(test.base))
+			if err != nil {
+				t.Fatal(err)
+			}
+			version, err := store.putDelta([]byte(test.content), baseVersion.SHA256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256([]byte(test.content))
+			if version.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("hash %s, want %x", version.SHA256, sum)
+			}
+			if version.Size != int64(len(test.content)) {
+				t.Errorf("size %d, want %d", version.Size, len(test.content))
+			}
+			content, err := store.Read(version.SHA256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != test.content {
+				t.Errorf("read back %d bytes that differ from the %d stored", len(content), len(test.content))
+			}
+			_, depth, err := store.load(version.SHA256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if depth != test.depth {
+				t.Errorf("depth %d, want %d", depth, test.depth)
+			}
+		})
+	}
+}
+
+func TestSnapshotStoreDeltaChain(t *testing.T) {
+	store := NewSnapshotStore(t.TempDir(), true)
+	content := "id,value\n" + strings.Repeat("1,10\n", 100)
+	version, err := store.Put(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxDeltaChain*2; i++ {
+		content += strings.Repeat("2,20\n", i+1)
+		version, err = store.putDelta([]byte(content), version.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, depth, err := store.load(version.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(read) != content {
+			t.Fatalf("version %d reads back wrong", i)
+		}
+		// the chain starts over with a full copy once it is as long as it may get
+		if want := (i + 1) % (maxDeltaChain + 1); depth != want {
+			t.Errorf("version %d is %d deltas deep, want %d", i, depth, want)
+		}
+	}
+}
+
+func TestSnapshotStoreRead(t *testing.T) {
+	dir := t.TempDir()
+	store := NewSnapshotStore(dir, false)
+	content := []byte("id,value\n1,10\n")
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	tests := []struct {
+		name string
+		// what is on disk under the hash of content
+		object []byte
+		err    bool
+	}{
+		{name: "uncompressed from before compression", object: content},
+		{name: "corrupted", object: []byte("id,value\n1,11\n"), err: true},
+		{name: "empty gzip", object: gzipBytes(t, nil), err: true},
+		{name: "unknown kind", object: gzipBytes(t, append([]byte{'X'}, content...)), err: true},
+		{name: "delta cut short", object: gzipBytes(t, []byte{objectDelta, 'a', 'b'}), err: true},
+		{name: "delta with a missing base", object: gzipBytes(t, append([]byte{objectDelta}, strings.Repeat("0", 64)+"\x00\x00"...)), err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := store.objectPath(hash)
+			err := os.MkdirAll(filepath.Dir(path), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(path, test.object, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			read, err := store.Read(hash)
+			if test.err {
+				if err == nil {
+					t.Errorf("read %q, want an error", read)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(read, content) {
+				t.Errorf("read %q, want %q", read, content)
+			}
+		})
+	}
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRetentionPolicyKeep(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	var versions []SnapshotVersion
+	for _, daysAgo := range []int{90, 60, 30, 10, 1} {
+		versions = append(versions, SnapshotVersion{SHA256: fmt.Sprint(daysAgo), FetchedAt: now.AddDate(0, 0, -daysAgo)})
+	}
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		// days ago of the versions that are kept
+		kept []string
+	}{
+		{name: "no rules", policy: RetentionPolicy{}, kept: []string{"90", "60", "30", "10", "1"}},
+		{name: "last two", policy: RetentionPolicy{KeepVersions: 2}, kept: []string{"10", "1"}},
+		{name: "more than there are", policy: RetentionPolicy{KeepVersions: 10}, kept: []string{"90", "60", "30", "10", "1"}},
+		{name: "last month", policy: RetentionPolicy{KeepDays: 31}, kept: []string{"30", "10", "1"}},
+		{name: "quota alone", policy: RetentionPolicy{Quota: 100}, kept: []string{"90", "60", "30", "10", "1"}},
+		{name: "latest always", policy: RetentionPolicy{KeepDays: 1}, kept: []string{"1"}},
+		{name: "either rule", policy: RetentionPolicy{KeepVersions: 1, KeepDays: 45}, kept: []string{"30", "10", "1"}},
+		{name: "either rule the other way", policy: RetentionPolicy{KeepVersions: 4, KeepDays: 5}, kept: []string{"60", "30", "10", "1"}},
+	}
+	for _, test := range tests {
+		kept, pruned := test.policy.keep(versions, now)
+		var keptIds []string
+		for _, version := range kept {
+			keptIds = append(keptIds, version.SHA256)
+		}
+		if strings.Join(keptIds, ",") != strings.Join(test.kept, ",") {
+			t.Errorf("%s: kept %v, want %v", test.name, keptIds, test.kept)
+		}
+		if len(kept)+len(pruned) != len(versions) {
+			t.Errorf("%s: kept %d and pruned %d of %d versions", test.name, len(kept), len(pruned), len(versions))
+		}
+	}
+}
+
+// run the test from an empty directory, everything works relative to data/
+func chdirTemp(t *testing.T) {
+	dir := t.TempDir()
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+func TestCollectGarbage(t *testing.T) {
+	tests := []struct {
+		name   string
+		deltas bool
+		policy RetentionPolicy
+		dryRun bool
+		// how far the quota is set below what the data directory takes, zero for no quota
+		overQuota int64
+		pruned    int
+		evicted   []string
+		deleted   int
+		// versions each resource is left with
+		versions map[string]int
+		// quarantined files deleted, of the two there are
+		quarantined int
+	}{
+		{name: "no policy", versions: map[string]int{"old-r": 3, "new-r": 2}},
+		{name: "keep one version", policy: RetentionPolicy{KeepVersions: 1}, pruned: 3, deleted: 3, versions: map[string]int{"old-r": 1, "new-r": 1}},
+		{name: "keep one version of deltas", deltas: true, policy: RetentionPolicy{KeepVersions: 1}, pruned: 3, deleted: 0, versions: map[string]int{"old-r": 1, "new-r": 1}},
+		{name: "keep days", policy: RetentionPolicy{KeepDays: 35}, pruned: 2, deleted: 2, versions: map[string]int{"old-r": 1, "new-r": 2}},
+		{name: "dry run", policy: RetentionPolicy{KeepVersions: 1}, dryRun: true, pruned: 3, deleted: 3, versions: map[string]int{"old-r": 3, "new-r": 2}},
+		{name: "over quota", overQuota: 1, evicted: []string{filepath.Join("data", "org", "old")}, deleted: 3, versions: map[string]int{"old-r": 0, "new-r": 2}},
+		{name: "old quarantine", policy: RetentionPolicy{QuarantineDays: 7}, versions: map[string]int{"old-r": 3, "new-r": 2}, quarantined: 1},
+		{name: "old quarantine dry run", policy: RetentionPolicy{QuarantineDays: 7}, dryRun: true, versions: map[string]int{"old-r": 3, "new-r": 2}, quarantined: 1},
+		{name: "recent quarantine", policy: RetentionPolicy{QuarantineDays: 60}, versions: map[string]int{"old-r": 3, "new-r": 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chdirTemp(t)
+			now := time.Now().UTC()
+			snapshots := NewSnapshotStore(filepath.Join("data", "objects"), test.deltas)
+			err := os.MkdirAll("data", 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state, err := loadState(filepath.Join("data", "state.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer state.Close()
+			content := "id,value\n" + strings.Repeat("1,10\n", 200)
+			resources := []struct {
+				id, dataset string
+				daysAgo     []int
+			}{
+				{id: "old-r", dataset: "old", daysAgo: []int{60, 40, 30}},
+				{id: "new-r", dataset: "new", daysAgo: []int{2, 1}},
+			}
+			for _, resource := range resources {
+				csvPath := filepath.Join("data", "org", resource.dataset, resource.id+".csv")
+				err := os.MkdirAll(filepath.Dir(csvPath), 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var version SnapshotVersion
+				var fetchedAt time.Time
+				for _, daysAgo := range resource.daysAgo {
+					content += resource.id + fmt.Sprint(daysAgo) + "\n"
+					fetchedAt = now.AddDate(0, 0, -daysAgo)
+					version, err = snapshots.Record(csvPath, strings.NewReader(content), fetchedAt, fetchedAt.Format(time.RFC3339))
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				err = os.WriteFile(csvPath, []byte(content), 0644)
+				if err == nil {
+					err = os.Chtimes(csvPath, fetchedAt, fetchedAt)
+				}
+				if err == nil {
+					err = state.Put(resource.id, ResourceState{PackageId: resource.dataset, Organization: "org", MetadataModified: version.MetadataModified, SHA256: version.SHA256})
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// what gc can not free is big but does not count
+			uncounted := map[string]time.Time{
+				filepath.Join("data", ".git", "objects", "pack", "big.pack"): now,
+				filepath.Join("data", "reports", "run.json"):                 now,
+				filepath.Join("data", "events", "event.json"):                now,
+				filepath.Join("data", "quarantine", "old-r-old.body"):        now.AddDate(0, 0, -30),
+				filepath.Join("data", "quarantine", "old-r-new.body"):        now,
+			}
+			for path, modTime := range uncounted {
+				err := os.MkdirAll(filepath.Dir(path), 0755)
+				if err == nil {
+					err = os.WriteFile(path, nil, 0644)
+				}
+				if err == nil {
+					err = os.Truncate(path, 1<<30)
+				}
+				if err == nil {
+					err = os.Chtimes(path, modTime, modTime)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			policy := test.policy
+			if test.overQuota > 0 {
+				report, err := collectGarbage(state, snapshots, RetentionPolicy{}, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				policy.Quota = report.UsedBytes - test.overQuota
+			}
+			report, err := collectGarbage(state, snapshots, policy, test.dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.PrunedVersions) != test.pruned {
+				t.Errorf("pruned %d versions, want %d", len(report.PrunedVersions), test.pruned)
+			}
+			var evicted []string
+			for _, dataset := range report.EvictedDatasets {
+				evicted = append(evicted, dataset.Path)
+			}
+			if strings.Join(evicted, ",") != strings.Join(test.evicted, ",") {
+				t.Errorf("evicted %v, want %v", evicted, test.evicted)
+			}
+			if report.DeletedObjects != test.deleted {
+				t.Errorf("deleted %d objects, want %d", report.DeletedObjects, test.deleted)
+			}
+			if report.UsedBytes >= 1<<30 {
+				t.Errorf("used %d bytes, counting what gc can not free", report.UsedBytes)
+			}
+			if report.DeletedQuarantined != test.quarantined {
+				t.Errorf("deleted %d quarantined files, want %d", report.DeletedQuarantined, test.quarantined)
+			}
+			entries, err := os.ReadDir(filepath.Join("data", "quarantine"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			left := 2
+			if !test.dryRun {
+				left -= test.quarantined
+			}
+			if len(entries) != left {
+				t.Errorf("%d quarantined files left, want %d", len(entries), left)
+			}
+			for _, resource := range resources {
+				csvPath := filepath.Join("data", "org", resource.dataset, resource.id+".csv")
+				versions, err := loadVersions(csvPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(versions) != test.versions[resource.id] {
+					t.Errorf("%s has %d versions, want %d", resource.id, len(versions), test.versions[resource.id])
+				}
+				// an evicted resource is stored again on its next update rather than announced as new
+				resourceState, _ := state.Get(resource.id)
+				evicted := len(versions) == 0
+				if resourceState.Evicted != evicted || evicted && (resourceState.SHA256 != "" || resourceState.MetadataModified != "") {
+					t.Errorf("%s is left with state %+v", resource.id, resourceState)
+				}
+				// whatever is left has to read back, bases of deltas included
+				for _, version := range versions {
+					_, err := snapshots.Read(version.SHA256)
+					if err != nil {
+						t.Errorf("%s: %v", resource.id, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSafePathComponent(t *testing.T) {
+	tests := []struct {
+		value string
+		safe  bool
+	}{
+		{value: "cbs", safe: true},
+		{value: "ministry-of-health", safe: true},
+		{value: "d3a1c2f0-5b7e-4c8e-9f6a-0123456789ab", safe: true},
+		{value: "under_score", safe: true},
+		{value: "A1", safe: true},
+		{value: strings.Repeat("a", 128), safe: true},
+		{value: strings.Repeat("a", 129), safe: false},
+		{value: "", safe: false},
+		{value: ".", safe: false},
+		{value: "..", safe: false},
+		{value: "../etc", safe: false},
+		{value: "a/b", safe: false},
+		{value: "a\\b", safe: false},
+		{value: "-flag", safe: false},
+		{value: "_hidden", safe: false},
+		{value: ".hidden", safe: false},
+		{value: "with space", safe: false},
+		{value: "משרד-הבריאות", safe: false},
+		{value: "a\x00b", safe: false},
+		{value: "trailing\n", safe: false},
+	}
+	for _, test := range tests {
+		if safe := safePathComponent.MatchString(test.value); safe != test.safe {
+			t.Errorf("safePathComponent(%q) = %v, want %v", test.value, safe, test.safe)
+		}
+	}
+}
+
+func TestResourceCsvPath(t *testing.T) {
+	tests := []struct {
+		name         string
+		organization Organization
+		packageId    string
+		resourceId   string
+		// empty when the ids are rejected
+		path string
+	}{
+		{name: "usable names", organization: Organization{Id: "org-id", Name: "cbs"}, packageId: "pkg", resourceId: "res", path: filepath.Join("data", "cbs", "pkg", "res.csv")},
+		{name: "hebrew organization name", organization: Organization{Id: "org-id", Name: "משרד"}, packageId: "pkg", resourceId: "res", path: filepath.Join("data", "org-id", "pkg", "res.csv")},
+		{name: "traversing organization name", organization: Organization{Id: "org-id", Name: ".."}, packageId: "pkg", resourceId: "res", path: filepath.Join("data", "org-id", "pkg", "res.csv")},
+		{name: "no usable organization", organization: Organization{Id: "../x", Name: ""}, packageId: "pkg", resourceId: "res"},
+		{name: "traversing dataset id", organization: Organization{Name: "cbs"}, packageId: "../../etc", resourceId: "res"},
+		{name: "empty dataset id", organization: Organization{Name: "cbs"}, packageId: "", resourceId: "res"},
+		{name: "traversing resource id", organization: Organization{Name: "cbs"}, packageId: "pkg", resourceId: "../state"},
+		{name: "resource id with a slash", organization: Organization{Name: "cbs"}, packageId: "pkg", resourceId: "a/b"},
+	}
+	for _, test := range tests {
+		datapackage := FileResultItem{Id: test.packageId, Organization: test.organization}
+		path, err := resourceCsvPath(datapackage, Resource{Id: test.resourceId})
+		if test.path == "" {
+			if err == nil {
+				t.Errorf("%s: got %s, want an error", test.name, path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if path != test.path {
+			t.Errorf("%s: got %s, want %s", test.name, path, test.path)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04:05", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	tests := []struct {
+		expr  string
+		after string
+		// empty when the expression never matches
+		next string
+	}{
+		{expr: "* * * * *", after: "2026-10-18 10:07:30", next: "2026-10-18 10:08:00"},
+		{expr: "*/15 * * * *", after: "2026-10-18 10:07:00", next: "2026-10-18 10:15:00"},
+		{expr: "*/15 * * * *", after: "2026-10-18 10:45:00", next: "2026-10-18 11:00:00"},
+		{expr: "0 6,14,22 * * *", after: "2026-10-18 10:00:00", next: "2026-10-18 14:00:00"},
+		{expr: "0 6,14,22 * * *", after: "2026-10-18 22:00:00", next: "2026-10-19 06:00:00"},
+		{expr: "0 6 * * *", after: "2026-10-18 05:59:59", next: "2026-10-18 06:00:00"},
+		{expr: "0 6 * * *", after: "2026-10-18 06:00:00", next: "2026-10-19 06:00:00"},
+		{expr: "30 9-17/2 * * *", after: "2026-10-18 12:00:00", next: "2026-10-18 13:30:00"},
+		{expr: "30 9-17/2 * * *", after: "2026-10-18 17:30:00", next: "2026-10-19 09:30:00"},
+		{expr: "0 0 1 * *", after: "2026-02-15 00:00:00", next: "2026-03-01 00:00:00"},
+		{expr: "0 0 31 * *", after: "2026-04-01 00:00:00", next: "2026-05-31 00:00:00"},
+		{expr: "0 0 1 1,7 *", after: "2026-02-01 00:00:00", next: "2026-07-01 00:00:00"},
+		{expr: "0 0 29 2 *", after: "2026-03-01 00:00:00", next: "2028-02-29 00:00:00"},
+		{expr: "0 0 30 2 *", after: "2026-03-01 00:00:00", next: ""},
+		// 2026-10-18 is a sunday
+		{expr: "0 8 * * 1-5", after: "2026-10-23 09:00:00", next: "2026-10-26 08:00:00"},
+		{expr: "0 0 * * 0", after: "2026-10-18 12:00:00", next: "2026-10-25 00:00:00"},
+		{expr: "0 0 * * 7", after: "2026-10-18 12:00:00", next: "2026-10-25 00:00:00"},
+		{expr: "0 0 * * 5,6", after: "2026-10-18 12:00:00", next: "2026-10-23 00:00:00"},
+		// with both day fields restricted either one is enough
+		{expr: "0 0 13 * 5", after: "2026-10-18 00:00:00", next: "2026-10-23 00:00:00"},
+		{expr: "0 0 1 * 1", after: "2026-10-27 00:00:00", next: "2026-11-01 00:00:00"},
+		// a day field that starts with * leaves the other one in charge, both have to match
+		{expr: "0 0 */2 * 1", after: "2026-10-20 00:00:00", next: "2026-11-09 00:00:00"},
+		{expr: "0 0 13 * *", after: "2026-10-18 00:00:00", next: "2026-11-13 00:00:00"},
+	}
+	for _, test := range tests {
+		schedule, err := ParseCronSchedule(test.expr)
+		if err != nil {
+			t.Errorf("ParseCronSchedule(%q): %v", test.expr, err)
+			continue
+		}
+		next := schedule.Next(at(test.after))
+		if test.next == "" {
+			if !next.IsZero() {
+				t.Errorf("%q after %s = %s, want it to never match", test.expr, test.after, next)
+			}
+			continue
+		}
+		if want := at(test.next); !next.Equal(want) {
+			t.Errorf("%q after %s = %s, want %s", test.expr, test.after, next, want)
+		}
+	}
+}
+
+func TestParseCronScheduleErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+		"1,,2 * * * *",
+	}
+	for _, expr := range tests {
+		if _, err := ParseCronSchedule(expr); err == nil {
+			t.Errorf("ParseCronSchedule(%q) parsed, want an error", expr)
+		}
+	}
+}
+
+func TestResourceRulesMatch(t *testing.T) {
+	datapackage := FileResultItem{
+		Id:           "pkg",
+		Frequency:    "weekly",
+		Organization: Organization{Id: "org-id", Name: "cbs"},
+		Tags:         []Tag{{Name: "health", DisplayName: "Health"}},
+	}
+	resource := Resource{Id: "res", Name: "Hospital beds 2026", Format: "CSV", Size: 5000}
+	tests := []struct {
+		name     string
+		rules    ResourceRules
+		resource Resource
+		ok       bool
+		reason   string
+	}{
+		{name: "no rules", resource: resource, ok: true},
+		{name: "allowed by id", rules: ResourceRules{Allow: []ResourceRule{{Ids: []string{"RES"}}}}, resource: resource, ok: true},
+		{name: "allowed by organization name", rules: ResourceRules{Allow: []ResourceRule{{Organizations: []string{"cbs"}}}}, resource: resource, ok: true},
+		{name: "allowed by organization id", rules: ResourceRules{Allow: []ResourceRule{{Organizations: []string{"org-id"}}}}, resource: resource, ok: true},
+		{name: "allowed by tag display name", rules: ResourceRules{Allow: []ResourceRule{{Tags: []string{"health"}}}}, resource: resource, ok: true},
+		{name: "allowed by the second rule", rules: ResourceRules{Allow: []ResourceRule{{Ids: []string{"other"}}, {Formats: []string{"csv"}}}}, resource: resource, ok: true},
+		{name: "not allowed", rules: ResourceRules{Allow: []ResourceRule{{Ids: []string{"other"}}}}, resource: resource, reason: "no allow rule matches"},
+		{name: "every condition has to match", rules: ResourceRules{Allow: []ResourceRule{{Organizations: []string{"cbs"}, Tags: []string{"finance"}}}}, resource: resource, reason: "no allow rule matches"},
+		{name: "denied", rules: ResourceRules{Deny: []ResourceRule{{Name: "no cbs", Organizations: []string{"cbs"}}}}, resource: resource, reason: "denied by rule no cbs"},
+		{name: "deny wins", rules: ResourceRules{Allow: []ResourceRule{{Ids: []string{"res"}}}, Deny: []ResourceRule{{Formats: []string{"CSV"}}}}, resource: resource, reason: "denied by rule formats=CSV"},
+		{name: "deny that does not match", rules: ResourceRules{Deny: []ResourceRule{{Formats: []string{"XLSX"}}}}, resource: resource, ok: true},
+		{name: "within the size range", rules: ResourceRules{Allow: []ResourceRule{{MinSize: 1000, MaxSize: 10000}}}, resource: resource, ok: true},
+		{name: "too big", rules: ResourceRules{Deny: []ResourceRule{{MinSize: 4000}}}, resource: resource, reason: "denied by rule size=4000-0"},
+		{name: "unknown size is outside every range", rules: ResourceRules{Deny: []ResourceRule{{MinSize: 1}}}, resource: Resource{Id: "res", Format: "CSV"}, ok: true},
+		{name: "name pattern", rules: ResourceRules{Allow: []ResourceRule{{NamePattern: `^Hospital .* \d{4}$`}}}, resource: resource, ok: true},
+		{name: "name pattern that does not match", rules: ResourceRules{Allow: []ResourceRule{{NamePattern: `^Budget`}}}, resource: resource, reason: "no allow rule matches"},
+		{name: "frequency of the dataset", rules: ResourceRules{Deny: []ResourceRule{{Frequencies: []string{"weekly"}}}}, resource: resource, reason: "denied by rule frequencies=weekly"},
+		{name: "csv by default", rules: defaultConfig().Resources, resource: resource, ok: true},
+		{name: "other formats left out by default", rules: defaultConfig().Resources, resource: Resource{Id: "res", Format: "XLSX"}, reason: "no allow rule matches"},
+		{name: "other formats allowed by the config", rules: ResourceRules{Allow: []ResourceRule{{Formats: []string{"CSV", "TSV"}}}}, resource: Resource{Id: "res", Format: "TSV"}, ok: true},
+		{name: "frequency of the resource first", rules: ResourceRules{Deny: []ResourceRule{{Frequencies: []string{"weekly"}}}}, resource: Resource{Id: "res", Format: "CSV", Frequency: "daily"}, ok: true},
+	}
+	for _, test := range tests {
+		for i := range test.rules.Allow {
+			err := test.rules.Allow[i].compile("allow")
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		for i := range test.rules.Deny {
+			err := test.rules.Deny[i].compile("deny")
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		ok, reason := test.rules.Match(datapackage, test.resource)
+		if ok != test.ok || reason != test.reason {
+			t.Errorf("%s: Match = %v, %q, want %v, %q", test.name, ok, reason, test.ok, test.reason)
+		}
+	}
+}
+
+func TestResourceRuleCompile(t *testing.T) {
+	tests := []struct {
+		name string
+		rule ResourceRule
+		err  bool
+	}{
+		{name: "ids", rule: ResourceRule{Ids: []string{"res"}}},
+		{name: "size range", rule: ResourceRule{MinSize: 10, MaxSize: 20}},
+		{name: "open size range", rule: ResourceRule{MinSize: 10}},
+		{name: "no conditions", rule: ResourceRule{Name: "everything"}, err: true},
+		{name: "negative size", rule: ResourceRule{MinSize: -1}, err: true},
+		{name: "size range the wrong way", rule: ResourceRule{MinSize: 20, MaxSize: 10}, err: true},
+		{name: "bad name pattern", rule: ResourceRule{NamePattern: "("}, err: true},
+	}
+	for _, test := range tests {
+		err := test.rule.compile("rule")
+		if (err != nil) != test.err {
+			t.Errorf("%s: compile = %v, want an error %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets []string
+		input   string
+		want    string
+	}{
+		{name: "nothing to hide", input: "token 123456789:AAEabc", want: "token 123456789:AAEabc"},
+		{name: "token", secrets: []string{"123456789:AAEabc"}, input: "token 123456789:AAEabc", want: "token <redacted>"},
+		{name: "in a url", secrets: []string{"123456789:AAEabc"}, input: `Post "https://api.telegram.org/bot123456789:AAEabc/sendMessage": EOF`, want: `Post "https://api.telegram.org/bot<redacted>/sendMessage": EOF`},
+		{name: "every occurrence", secrets: []string{"123456789:AAEabc"}, input: "123456789:AAEabc 123456789:AAEabc", want: "<redacted> <redacted>"},
+		{name: "escaped in a path", secrets: []string{"secret/with?chars"}, input: "/botsecret%2Fwith%3Fchars/getMe", want: "/bot<redacted>/getMe"},
+		{name: "short strings are left alone", secrets: []string{"abc"}, input: "abcabc", want: "abcabc"},
+		{name: "empty secret", secrets: []string{""}, input: "anything", want: "anything"},
+		{name: "two secrets", secrets: []string{"first-secret", "second-secret"}, input: "first-secret and second-secret", want: "<redacted> and <redacted>"},
+	}
+	for _, test := range tests {
+		redactor := &Redactor{}
+		for _, secret := range test.secrets {
+			redactor.Add(secret)
+		}
+		if got := redactor.Redact(test.input); got != test.want {
+			t.Errorf("%s: Redact(%q) = %q, want %q", test.name, test.input, got, test.want)
+		}
+	}
+}
+
+func TestTelegramClientScrub(t *testing.T) {
+	client := &TelegramClient{token: "123456789:AAEabc"}
+	err := client.scrub(&url.Error{Op: "Post", URL: "https://api.telegram.org/bot123456789:AAEabc/sendMessage", Err: io.ErrUnexpectedEOF})
+	if strings.Contains(err.Error(), client.token) {
+		t.Errorf("token left in %q", err)
+	}
+	// still the same error underneath, a dropped connection is still worth another try
+	if !errors.Is(err, io.ErrUnexpectedEOF) || !isRetryable(err) {
+		t.Errorf("scrubbed error %v lost what it wraps", err)
+	}
+}
+
+func TestUpdateResourceAfterEviction(t *testing.T) {
+	chdirTemp(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		fmt.Fprint(w, "id,name\n1,a\n2,b\n")
+	}))
+	defer server.Close()
+	err := os.MkdirAll("data", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadState(filepath.Join("data", "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	owed := &SendMessagePayload{Text: "owed from before"}
+	err = state.Put("res", ResourceState{PackageId: "pkg", Organization: "org", Outbox: owed, Evicted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := defaultConfig()
+	worker := &Worker{
+		config:       &config,
+		downloader:   NewDownloader(config.Download, 1, 1, 0, 0),
+		charDetector: chardet.NewTextDetector(),
+		retryPolicy:  RetryPolicy{MaxAttempts: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		state:        state,
+		snapshots:    NewSnapshotStore(filepath.Join("data", "objects"), false),
+		keepCsv:      true,
+		report:       &RunReport{FailuresByCategory: make(map[string]int)},
+	}
+	datapackage := FileResultItem{Id: "pkg", Organization: Organization{Name: "org"}}
+	resource := Resource{Id: "res", Url: server.URL, MetadataModified: "2026-10-18T12:00:00"}
+	csvPath, err := resourceCsvPath(datapackage, resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = worker.updateResource(context.Background(), datapackage, resource, csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resourceState, _ := state.Get("res")
+	if resourceState.Evicted || resourceState.SHA256 == "" || resourceState.MetadataModified != resource.MetadataModified {
+		t.Errorf("state %+v, want it stored again", resourceState)
+	}
+	if resourceState.Outbox == nil || resourceState.Outbox.Text != owed.Text {
+		t.Errorf("outbox %+v, want the message that was still owed", resourceState.Outbox)
+	}
+	versions, err := loadVersions(csvPath)
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("%d versions, %v", len(versions), err)
+	}
+	// the kept csv is on disk as well as the object
+	if worker.report.StoredBytes < versions[0].Size {
+		t.Errorf("stored %d bytes, less than the %d of the kept csv", worker.report.StoredBytes, versions[0].Size)
+	}
+	// nothing was announced
+	if _, err := os.Stat(filepath.Join("data", "events")); !os.IsNotExist(err) {
+		t.Errorf("a change event was written")
+	}
+}
+
+func TestFetchResourceKeepsOutbox(t *testing.T) {
+	chdirTemp(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		fmt.Fprint(w, "id,name\n1,a\n")
+	}))
+	defer server.Close()
+	err := os.MkdirAll("data", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadState(filepath.Join("data", "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	owed := &SendMessagePayload{Text: "owed from before"}
+	err = state.Put("res", ResourceState{PackageId: "pkg", Organization: "org", Outbox: owed, Retry: &RetryEntry{Reason: "empty"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := defaultConfig()
+	worker := &Worker{
+		config:       &config,
+		downloader:   NewDownloader(config.Download, 1, 1, 0, 0),
+		charDetector: chardet.NewTextDetector(),
+		retryPolicy:  RetryPolicy{MaxAttempts: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		state:        state,
+		snapshots:    NewSnapshotStore(filepath.Join("data", "objects"), false),
+		report:       &RunReport{FailuresByCategory: make(map[string]int)},
+	}
+	datapackage := FileResultItem{Id: "pkg", Organization: Organization{Name: "org"}}
+	resource := Resource{Id: "res", Url: server.URL, MetadataModified: "2026-10-18T12:00:00"}
+	err = worker.fetchResource(context.Background(), datapackage, resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resourceState, _ := state.Get("res")
+	if resourceState.SHA256 == "" || resourceState.MetadataModified != resource.MetadataModified {
+		t.Errorf("state %+v, want the download stored", resourceState)
+	}
+	if resourceState.Retry != nil {
+		t.Errorf("retry %+v, want it cleared", resourceState.Retry)
+	}
+	if resourceState.Outbox == nil || resourceState.Outbox.Text != owed.Text {
+		t.Errorf("outbox %+v, want the message that was still owed", resourceState.Outbox)
+	}
+}
+
+func TestFetchResourceDecodes(t *testing.T) {
+	chdirTemp(t)
+	content := "עיר,אוכלוסייה\nירושלים,1000000\nתל אביב,460000\nחיפה,285000\nבאר שבע,210000\n"
+	encoded, err := charmap.Windows1255.NewEncoder().String(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		fmt.Fprint(w, encoded)
+	}))
+	defer server.Close()
+	err = os.MkdirAll("data", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadState(filepath.Join("data", "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	config := defaultConfig()
+	worker := &Worker{
+		config:       &config,
+		downloader:   NewDownloader(config.Download, 1, 1, 0, 0),
+		charDetector: chardet.NewTextDetector(),
+		retryPolicy:  RetryPolicy{MaxAttempts: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		state:        state,
+		snapshots:    NewSnapshotStore(filepath.Join("data", "objects"), false),
+		keepCsv:      true,
+		report:       &RunReport{FailuresByCategory: make(map[string]int)},
+	}
+	datapackage := FileResultItem{Id: "pkg", Organization: Organization{Name: "org"}}
+	resource := Resource{Id: "res", Url: server.URL, MetadataModified: "2026-10-18T12:00:00"}
+	err = worker.fetchResource(context.Background(), datapackage, resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stored as utf-8, the same as an update would store it
+	resourceState, _ := state.Get("res")
+	stored, err := worker.snapshots.Read(resourceState.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != content {
+		t.Errorf("stored %q, want %q", stored, content)
+	}
+	csvPath, err := resourceCsvPath(datapackage, resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := os.ReadFile(csvPath)
+	if err != nil || string(kept) != content {
+		t.Errorf("kept %q, %v, want %q", kept, err, content)
+	}
+}
+
+func TestRunLockWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.lock")
+	lock, err := AcquireRunLock(path, "bootstrap", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+	// a shorter heartbeat over a longer one leaves nothing of the old one behind
+	lock.info.Mode = "run"
+	err = lock.write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info RunLockInfo
+	err = json.Unmarshal(data, &info)
+	if err != nil || info.Mode != "run" {
+		t.Errorf("lock file %q, %v", data, err)
+	}
+}
+
+func TestParseRunLockInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		mode string
+		err  bool
+	}{
+		{name: "heartbeat", data: `{"pid":1,"mode":"run"}`, mode: "run"},
+		{name: "left over from a longer heartbeat", data: `{"pid":1,"mode":"run"}ap"}`, mode: "run"},
+		{name: "empty", data: "", err: true},
+		{name: "cut short", data: `{"pid":1,"mo`, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info, err := parseRunLockInfo([]byte(test.data))
+			if (err != nil) != test.err {
+				t.Fatalf("err %v, want error %v", err, test.err)
+			}
+			if info.Mode != test.mode {
+				t.Errorf("mode %q, want %q", info.Mode, test.mode)
+			}
+		})
+	}
+}
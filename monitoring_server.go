@@ -1,16 +1,105 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"log"
+	"io/fs"
+	"log/slog"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
+// the part of the worker's datasoup.yaml the server cares about
+type MonitoringServerConfig struct {
+	Monitoring struct {
+		Port      int           `yaml:"port"`
+		MaxRunAge time.Duration `yaml:"max_run_age"`
+	} `yaml:"monitoring"`
+	Log struct {
+		Level  string `yaml:"level"`
+		Format string `yaml:"format"`
+	} `yaml:"log"`
+}
+
+// an empty variable counts as unset, the same as in the worker
+func lookupEnv(name string) (string, bool) {
+	value := os.Getenv(name)
+	return value, value != ""
+}
+
+// same file and environment variables as the worker
+func loadMonitoringConfig() (*MonitoringServerConfig, error) {
+	var config MonitoringServerConfig
+	config.Monitoring.Port = 8080
+	config.Monitoring.MaxRunAge = 24 * time.Hour
+	config.Log.Level = "info"
+	config.Log.Format = "json"
+	path := os.Getenv("DATASOUP_CONFIG")
+	if path == "" {
+		path = "datasoup.yaml"
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = yaml.Unmarshal(data, &config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if value, ok := lookupEnv("DATASOUP_MONITORING_PORT"); ok {
+		config.Monitoring.Port, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("DATASOUP_MONITORING_PORT: %q is not a number", value)
+		}
+	}
+	if config.Monitoring.Port < 1 || config.Monitoring.Port > 65535 {
+		return nil, fmt.Errorf("monitoring.port %d is not a port", config.Monitoring.Port)
+	}
+	if value, ok := lookupEnv("DATASOUP_MONITORING_MAX_RUN_AGE"); ok {
+		config.Monitoring.MaxRunAge, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("DATASOUP_MONITORING_MAX_RUN_AGE: %q is not a duration", value)
+		}
+	}
+	if config.Monitoring.MaxRunAge <= 0 {
+		return nil, fmt.Errorf("monitoring.max_run_age %s has to be positive", config.Monitoring.MaxRunAge)
+	}
+	if value, ok := lookupEnv("DATASOUP_LOG_LEVEL"); ok {
+		config.Log.Level = value
+	}
+	if value, ok := lookupEnv("DATASOUP_LOG_FORMAT"); ok {
+		config.Log.Format = value
+	}
+	if config.Log.Format != "json" && config.Log.Format != "text" {
+		return nil, fmt.Errorf("log.format %q is neither json nor text", config.Log.Format)
+	}
+	return &config, nil
+}
+
+// json lines on stderr like the worker writes them
+func (c *MonitoringServerConfig) logger() (*slog.Logger, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.Log.Level))
+	if err != nil {
+		return nil, fmt.Errorf("log.level %q is none of debug, info, warn and error", c.Log.Level)
+	}
+	options := &slog.HandlerOptions{Level: level}
+	if c.Log.Format == "text" {
+		return slog.New(slog.NewTextHandler(os.Stderr, options)), nil
+	}
+	return slog.New(slog.NewJSONHandler(os.Stderr, options)), nil
+}
+
 // Local types for monitoring server only
 type MonitoringFile struct {
 	Success bool                 `json:"success"`
@@ -44,8 +133,58 @@ type MonitoringTag struct {
 	State       string `json:"state"`
 }
 
+// what the worker writes to data/status.json
+type MonitoringWorkerStatus struct {
+	State         string     `json:"state"`
+	Mode          string     `json:"mode"`
+	Daemon        bool       `json:"daemon"`
+	Schedule      string     `json:"schedule"`
+	RunStartedAt  time.Time  `json:"run_started_at"`
+	RunFinishedAt time.Time  `json:"run_finished_at"`
+	NextRunAt     *time.Time `json:"next_run_at"`
+	LastError     string     `json:"last_error"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// the part of data/last_run.json we show
+type MonitoringRunReport struct {
+	Mode        string    `json:"mode"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Checked     int       `json:"checked"`
+	Updated     int       `json:"updated"`
+	Failed      int       `json:"failed"`
+	Interrupted bool      `json:"interrupted"`
+}
+
+// what the worker writes to data/metrics.json, counted over every run
+type MonitoringMetrics struct {
+	ResourcesChecked    int64                `json:"resources_checked"`
+	ResourcesFetched    int64                `json:"resources_fetched"`
+	ResourcesChanged    int64                `json:"resources_changed"`
+	ResourcesFailed     map[string]int64     `json:"resources_failed"`
+	DownloadedBytes     int64                `json:"downloaded_bytes"`
+	DownloadSeconds     MonitoringHistogram  `json:"download_seconds"`
+	DiffLines           MonitoringHistogram  `json:"diff_lines"`
+	NotificationsSent   map[string]int64     `json:"notifications_sent"`
+	NotificationsFailed map[string]int64     `json:"notifications_failed"`
+	TelegramRateLimited int64                `json:"telegram_rate_limited"`
+	LastSuccess         map[string]time.Time `json:"last_success"`
+	UpdatedAt           time.Time            `json:"updated_at"`
+}
+
+// counts[i] is how many observations were at most buckets[i]
+type MonitoringHistogram struct {
+	Buckets []float64 `json:"buckets"`
+	Counts  []int64   `json:"counts"`
+	Sum     float64   `json:"sum"`
+	Count   int64     `json:"count"`
+}
+
 type MonitoringData struct {
 	LastUpdate string
+	Worker     *MonitoringWorkerStatus
+	LastRun    *MonitoringRunReport
 	Datasets   []DatasetInfo
 }
 
@@ -75,6 +214,7 @@ const htmlTemplate = `
         .dataset-link { color: #0066cc; text-decoration: none; }
         .dataset-link:hover { text-decoration: underline; }
         .tags { font-size: 0.9em; color: #666; }
+        .error { color: #cc0000; }
     </style>
 </head>
 <body>
@@ -82,6 +222,8 @@ const htmlTemplate = `
         <h1>🍲 DataSoup Monitoring</h1>
         <p><strong>Last Update:</strong> {{.LastUpdate}}</p>
         <p><strong>Total Datasets:</strong> {{len .Datasets}}</p>
+        <p><strong>Worker:</strong> {{with .Worker}}{{.State}}{{if .Schedule}} ({{.Schedule}}){{end}}{{if eq .State "running"}} since {{.RunStartedAt.Local.Format "2006-01-02 15:04:05"}}{{end}}{{if .NextRunAt}}, next run at {{.NextRunAt.Local.Format "2006-01-02 15:04:05"}}{{end}}{{if .LastError}} <span class="error">last error: {{.LastError}}</span>{{end}}{{else}}no status yet{{end}}</p>
+        <p><strong>Last Run:</strong> {{with .LastRun}}{{.Mode}} finished {{.FinishedAt.Local.Format "2006-01-02 15:04:05"}}, {{.Updated}} of {{.Checked}} resources updated, {{.Failed}} failed{{if .Interrupted}}, <span class="error">interrupted</span>{{end}}{{else}}none yet{{end}}</p>
     </div>
     
     <table>
@@ -138,7 +280,7 @@ func loadMonitoringData() (*MonitoringData, error) {
 	for _, pkg := range datafile.Result.Results {
 		lastModified, err := time.Parse("2006-01-02T15:04:05.000000", pkg.MetadataModified)
 		if err != nil {
-			log.Printf("Error parsing time for %s: %v", pkg.Id, err)
+			slog.Warn("Error parsing time", "package", pkg.Id, "err", err)
 			continue
 		}
 
@@ -158,6 +300,18 @@ func loadMonitoringData() (*MonitoringData, error) {
 		})
 	}
 
+	// the worker status and the last run report are there once the worker ran
+	var worker *MonitoringWorkerStatus
+	err = loadOptionalJson("data/status.json", &worker)
+	if err != nil {
+		slog.Warn("Error loading worker status", "err", err)
+	}
+	var lastRun *MonitoringRunReport
+	err = loadOptionalJson("data/last_run.json", &lastRun)
+	if err != nil {
+		slog.Warn("Error loading last run report", "err", err)
+	}
+
 	// Sort by last modified time (most recent first)
 	sort.Slice(datasets, func(i, j int) bool {
 		return datasets[i].LastModifiedTime.After(datasets[j].LastModifiedTime)
@@ -165,10 +319,23 @@ func loadMonitoringData() (*MonitoringData, error) {
 
 	return &MonitoringData{
 		LastUpdate: fileInfo.ModTime().Format("2006-01-02 15:04:05"),
+		Worker:     worker,
+		LastRun:    lastRun,
 		Datasets:   datasets,
 	}, nil
 }
 
+// leaves v alone when the file is not there
+func loadOptionalJson(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
 func monitoringHandler(w http.ResponseWriter, r *http.Request) {
 	data, err := loadMonitoringData()
 	if err != nil {
@@ -190,11 +357,253 @@ func monitoringHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// the prometheus text format, written by hand since it is all we need of a client library
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *metricsWriter) header(name string, kind string, help string) {
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (w *metricsWriter) sample(name string, labels string, value float64) {
+	fmt.Fprintf(&w.buf, "%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (w *metricsWriter) counter(name string, help string, value int64) {
+	w.header(name, "counter", help)
+	w.sample(name, "", float64(value))
+}
+
+// one series per label value, in a stable order
+func (w *metricsWriter) labeled(name string, kind string, help string, label string, values map[string]float64) {
+	w.header(name, kind, help)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		w.sample(name, fmt.Sprintf("{%s=%q}", label, key), values[key])
+	}
+}
+
+func (w *metricsWriter) histogram(name string, help string, h MonitoringHistogram) {
+	w.header(name, "histogram", help)
+	for i, bound := range h.Buckets {
+		if i < len(h.Counts) {
+			w.sample(name+"_bucket", fmt.Sprintf("{le=%q}", strconv.FormatFloat(bound, 'g', -1, 64)), float64(h.Counts[i]))
+		}
+	}
+	w.sample(name+"_bucket", `{le="+Inf"}`, float64(h.Count))
+	w.sample(name+"_sum", "", h.Sum)
+	w.sample(name+"_count", "", float64(h.Count))
+}
+
+func countsOf(m map[string]int64) map[string]float64 {
+	values := make(map[string]float64, len(m))
+	for key, count := range m {
+		values[key] = float64(count)
+	}
+	return values
+}
+
+// bytes of everything under dir
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		fileInfo, err := entry.Info()
+		if os.IsNotExist(err) {
+			// gone between listing and looking at it, a run or gc is busy
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size += fileInfo.Size()
+		return nil
+	})
+	return size, err
+}
+
+// the worker's counters from data/metrics.json, zero until it ran, and what we can see of the data directory ourselves
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var metrics MonitoringMetrics
+	err := loadOptionalJson("data/metrics.json", &metrics)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error loading metrics: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var out metricsWriter
+	out.counter("datasoup_resources_checked_total", "Resources the worker checked for a new version.", metrics.ResourcesChecked)
+	out.counter("datasoup_resources_fetched_total", "Downloads that went through.", metrics.ResourcesFetched)
+	out.counter("datasoup_resources_changed_total", "Resources stored and announced with a new version.", metrics.ResourcesChanged)
+	out.labeled("datasoup_resources_failed_total", "counter", "Resources that failed, by failure category.", "category", countsOf(metrics.ResourcesFailed))
+	out.counter("datasoup_downloaded_bytes_total", "Bytes read from download responses.", metrics.DownloadedBytes)
+	out.histogram("datasoup_download_duration_seconds", "Time a download that went through took.", metrics.DownloadSeconds)
+	out.histogram("datasoup_diff_lines", "Lines in the diff of a change, every line of a new resource.", metrics.DiffLines)
+	out.labeled("datasoup_notifications_sent_total", "counter", "Messages sent, by sink.", "sink", countsOf(metrics.NotificationsSent))
+	out.labeled("datasoup_notifications_failed_total", "counter", "Messages that could not be sent, by sink.", "sink", countsOf(metrics.NotificationsFailed))
+	out.counter("datasoup_telegram_rate_limited_total", "Answers from telegram that said 429 Too Many Requests.", metrics.TelegramRateLimited)
+	lastSuccess := make(map[string]float64, len(metrics.LastSuccess))
+	for mode, at := range metrics.LastSuccess {
+		lastSuccess[mode] = float64(at.Unix())
+	}
+	out.labeled("datasoup_last_success_timestamp_seconds", "gauge", "When a run last went through, by mode.", "mode", lastSuccess)
+	if !metrics.UpdatedAt.IsZero() {
+		out.header("datasoup_metrics_updated_timestamp_seconds", "gauge", "When the worker last wrote its metrics.")
+		out.sample("datasoup_metrics_updated_timestamp_seconds", "", float64(metrics.UpdatedAt.Unix()))
+	}
+	size, err := dirSize("data")
+	if err != nil {
+		slog.Warn("Error measuring the data directory", "err", err)
+	} else {
+		out.header("datasoup_data_dir_bytes", "gauge", "Bytes under the data directory.")
+		out.sample("datasoup_data_dir_bytes", "", float64(size))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(out.buf.Bytes())
+}
+
+type HealthCheck struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	// ok or failing
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// 200 when every check passes and 503 otherwise, with what every check found either way
+func healthHandler(checks map[string]func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := HealthReport{Status: "ok", Checks: make(map[string]HealthCheck, len(checks))}
+		for name, check := range checks {
+			err := check()
+			if err != nil {
+				report.Status = "failing"
+				report.Checks[name] = HealthCheck{Error: err.Error()}
+				continue
+			}
+			report.Checks[name] = HealthCheck{Ok: true}
+		}
+		status := http.StatusOK
+		if report.Status != "ok" {
+			status = http.StatusServiceUnavailable
+			slog.Warn("Health check failing", "path", r.URL.Path, "checks", report.Checks)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// the worker can not store anything otherwise, and neither can we tell
+func checkDataWritable() error {
+	// *.tmp stays out of the git archive should a run commit right now
+	file, err := os.CreateTemp("data", ".healthz-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString("ok")
+	err = errors.Join(err, file.Close())
+	os.Remove(file.Name())
+	return err
+}
+
+// the catalogue the next run compares against
+func checkPackageData() error {
+	data, err := os.ReadFile("data/packagedata.json")
+	if err != nil {
+		return err
+	}
+	var datafile MonitoringFile
+	err = json.Unmarshal(data, &datafile)
+	if err != nil {
+		return fmt.Errorf("data/packagedata.json does not parse: %v", err)
+	}
+	if !datafile.Success || len(datafile.Result.Results) == 0 {
+		return errors.New("data/packagedata.json has no datasets")
+	}
+	return nil
+}
+
+// when a run last went through, or the bootstrap while there has not been a run yet, from data/metrics.json or from the last run report of a worker that does not write metrics yet
+func lastSuccessfulRun() (time.Time, error) {
+	var metrics MonitoringMetrics
+	err := loadOptionalJson("data/metrics.json", &metrics)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// a manual bootstrap says nothing about whether the runs still get through
+	if last, ok := metrics.LastSuccess["run"]; ok {
+		return last, nil
+	}
+	if last, ok := metrics.LastSuccess["bootstrap"]; ok {
+		return last, nil
+	}
+	var last time.Time
+	var lastRun *MonitoringRunReport
+	err = loadOptionalJson("data/last_run.json", &lastRun)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if lastRun != nil && !lastRun.Interrupted && (lastRun.Checked == 0 || lastRun.Failed < lastRun.Checked) {
+		last = lastRun.FinishedAt
+	}
+	return last, nil
+}
+
+func checkLastRun(maxAge time.Duration) error {
+	last, err := lastSuccessfulRun()
+	if err != nil {
+		return err
+	}
+	if last.IsZero() {
+		return errors.New("no successful run yet")
+	}
+	if age := time.Since(last); age > maxAge {
+		return fmt.Errorf("the last successful run was %s ago at %s, more than %s", age.Round(time.Minute), last.Format(time.RFC3339), maxAge)
+	}
+	return nil
+}
+
 func main() {
+	config, err := loadMonitoringConfig()
+	var logger *slog.Logger
+	if err == nil {
+		logger, err = config.logger()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
 	http.HandleFunc("/", monitoringHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	// alive, restarting helps when this fails
+	http.HandleFunc("/healthz", healthHandler(map[string]func() error{
+		"data_writable": checkDataWritable,
+	}))
+	// the pipeline works, worth an alert when this fails
+	http.HandleFunc("/readyz", healthHandler(map[string]func() error{
+		"data_writable": checkDataWritable,
+		"packagedata":   checkPackageData,
+		"last_run": func() error {
+			return checkLastRun(config.Monitoring.MaxRunAge)
+		},
+	}))
 
-	fmt.Println("DataSoup monitoring server starting on :8080")
-	fmt.Println("Visit http://localhost:8080 to view the monitoring dashboard")
+	addr := fmt.Sprintf(":%d", config.Monitoring.Port)
+	slog.Info("DataSoup monitoring server starting", "addr", addr, "dashboard", fmt.Sprintf("http://localhost%s", addr))
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	err = http.ListenAndServe(addr, nil)
+	slog.Error("Monitoring server stopped", "err", err)
+	os.Exit(1)
 }